@@ -51,9 +51,13 @@ package msgpack
 import (
 	"io"
 	"bytes"
+	"encoding"
 	"reflect"
 	"math"
+	"sync"
+	"sync/atomic"
 	"fmt"
+	"strconv"
 	// "net"
 	"time"
 	// "runtime/debug"
@@ -80,19 +84,185 @@ var DefaultDecoderContainerResolver = SimpleDecoderContainerResolver {
 	BytesStringMapValue: true,
 }
 
+// Default DecoderOptions used when a nil parameter is passed to NewDecoderWithOptions()
+// (and by NewDecoder and Unmarshal).
+// Sample Usage:
+//   opts := msgpack.DefaultDecoderOptions // makes a copy
+//   opts.TextUnmarshaler = false // change some options
+//   err := msgpack.NewDecoderWithOptions(r, nil, &opts).Decode(&v)
+var DefaultDecoderOptions = DecoderOptions {
+	BinaryUnmarshaler: true,
+	TextUnmarshaler: true,
+	MaxDepth: 1000,
+}
+
+// DecoderOptions configures how a Decoder reads values from the stream.
+type DecoderOptions struct {
+	// BinaryUnmarshaler decodes a bin (or str, if TextUnmarshaler does not apply)
+	// into a value implementing encoding.BinaryUnmarshaler (and not Unmarshaler),
+	// by calling UnmarshalBinary.
+	BinaryUnmarshaler bool
+	// TextUnmarshaler decodes a str into a value implementing 
+	// encoding.TextUnmarshaler (and not Unmarshaler), by calling UnmarshalText.
+	TextUnmarshaler bool
+	
+	// The limits below guard against malicious or corrupt input, e.g. a 5-byte 
+	// array header claiming 4 billion elements. When a limit is exceeded,
+	// decoding fails with a *LimitError (wrapped in a *DecodeError), 
+	// before anything is allocated for it. A value of 0 means no limit, 
+	// except as noted for MaxContainerLen and MaxStringLen.
+	// 
+	// Unmarshal (and NewDecoderBytes) is also always limited by the length of its input: 
+	// a length in the stream longer than the bytes remaining fails with 
+	// io.ErrUnexpectedEOF (wrapped in a *DecodeError). When reading from an untrusted stream (e.g. a network 
+	// connection), also set MaxBytes.
+	
+	// MaxContainerLen is the maximum number of elements in an array or entries in a map.
+	// When reading from an io.Reader, 0 means StreamMaxContainerLen. Use -1 for no limit.
+	MaxContainerLen int
+	// MaxStringLen is the maximum length of a str, bin or extension data.
+	// When reading from an io.Reader, 0 means StreamMaxStringLen. Use -1 for no limit.
+	MaxStringLen int
+	// MaxDepth is the maximum nesting depth of arrays and maps.
+	MaxDepth int
+	// MaxBytes is the maximum number of bytes read by each call to Decode 
+	// (or any of the Read methods).
+	MaxBytes int64
+	
+	// DisallowUnknownFields fails decoding into a struct with an *UnknownFieldError
+	// if a key in the stream matches no field, instead of skipping its value.
+	DisallowUnknownFields bool
+	
+	// AliasInput makes []byte values (including RawMessage) decoded by a Decoder 
+	// reading from a []byte (see NewDecoderBytes) refer to the input, instead of 
+	// copying it. This saves allocating and copying, but the input must not be 
+	// modified while they are in use. It is ignored when reading from an io.Reader.
+	AliasInput bool
+}
+
+// The default limits when decoding from an io.Reader, whose length is unknown 
+// (see DecoderOptions.MaxContainerLen and MaxStringLen).
+const (
+	StreamMaxContainerLen = 1 << 20
+	StreamMaxStringLen = 1 << 24
+)
+
+// LimitError is returned when decoding exceeds a limit set in DecoderOptions.
+type LimitError struct {
+	Limit string // name of the DecoderOptions field, e.g. "MaxContainerLen"
+	Max int64
+	Value int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s of %d exceeded: %d", msgTagDec, e.Limit, e.Max, e.Value)
+}
+
+// UnknownFieldError is a key in the stream which matches no field of a struct
+// (see DecoderOptions.DisallowUnknownFields).
+type UnknownFieldError struct {
+	Field string       // the key in the stream (or index, e.g. "[5]", for a struct encoded as an array)
+	Type reflect.Type  // the struct type
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("%s: Unknown field %q for struct type %v", msgTagDec, e.Field, e.Type)
+}
+
+// MissingFieldError is a field tagged "required" (e.g. `msgpack:"name,required"`)
+// which is absent from the map in the stream.
+type MissingFieldError struct {
+	Field string       // the encode name of the field
+	Type reflect.Type  // the struct type
+}
+
+func (e *MissingFieldError) Error() string {
+	return fmt.Sprintf("%s: Missing required field %q for struct type %v", msgTagDec, e.Field, e.Type)
+}
+
+// DecodeError is returned when decoding fails (except at a clean end of the stream, 
+// where io.EOF is returned AS IS). It records where in the stream and where in 
+// the Go value the failure happened, and wraps the cause: a *SyntaxError, 
+// *UnmarshalTypeError, *LimitError, io.ErrUnexpectedEOF, an error from the 
+// reader or from an Unmarshaler, etc. Use errors.As and errors.Is to check for these.
+type DecodeError struct {
+	Offset int64 // offset in the stream of the descriptor of the value being decoded
+	Desc byte    // the descriptor byte at Offset
+	Path string  // path to the value being decoded, e.g. Orders[3].Items["sku"].Qty
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%v (at offset %d)", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("%v (at offset %d, path %s)", e.Err, e.Offset, e.Path)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// SyntaxError is an invalid descriptor byte in the stream.
+type SyntaxError struct {
+	Offset int64
+	Desc byte
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s: %shex: %x, dec: %d", msgTagDec, e.Msg, e.Desc, e.Desc)
+}
+
+// UnmarshalTypeError is a value in the stream which cannot be decoded into 
+// the Go type at that position, e.g. a str into an int, or 300 into an int8.
+type UnmarshalTypeError struct {
+	Value string       // the value in the stream, e.g. "Str" or "Int 300"
+	Type reflect.Type  // the Go type expected. nil for Decoder.ReadNil.
+	Offset int64
+	Desc byte
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Type == nil {
+		return fmt.Sprintf("%s: Unexpected %s in stream", msgTagDec, e.Value)
+	}
+	return fmt.Sprintf("%s: Cannot decode %s into Go value of type %v", msgTagDec, e.Value, e.Type)
+}
+
+// decPathElem is an element of the path to the value being decoded, 
+// kept on the Decoder for DecodeError.
+type decPathElem struct {
+	kind byte  // 'i' (array index), 'f' (struct field) or 'k' (map key)
+	index int
+	field string
+	key reflect.Value
+}
+
 // A Decoder reads and decodes an object from an input stream in the msgpack format.
 type Decoder struct {
 	r io.Reader
+	b []byte          // the input, if reading from a []byte (see NewDecoderBytes)
+	inBytes bool      // reading from b, at offset nread
 	dam DecoderContainerResolver
+	opts DecoderOptions
+	bd byte           // last descriptor read, or read ahead by PeekType (if peeked)
+	bdpos int64       // offset of bd in the stream
+	peeked bool
+	skipbuf []byte    // scratch buffer for discarding bytes (see Skip)
+	nread int64       // number of bytes read from the stream
+	start int64       // value of nread at the start of the current call (for MaxBytes)
+	inputLen int64    // length of the input, if known (e.g. Unmarshal). 0 if unknown.
+	path []decPathElem // containers being decoded (its length is the depth)
 	x [16]byte        //temp byte array re-used internally for efficiency
 	t1, t2, t4, t8 []byte // use these, so no need to constantly re-slice
 }
 
 // DecoderContainerResolver has the DecoderContainer method for getting a usable reflect.Value
-// when decoding a container (map, array, raw bytes) from a stream into a nil interface{}.
+// when decoding a container (map, array, str, bin) from a stream into a nil interface{}.
 type DecoderContainerResolver interface {
 	// DecoderContainer is used to get a proper reflect.Value when decoding 
-	// a msgpack map, array or raw bytes (for which the stream defines the length and 
+	// a msgpack map, array, str (raw bytes) or bin (for which the stream defines the length and 
 	// corresponding containerType) into a nil interface{}. 
 	// 
 	// This may be within the context of a container: ([]interface{} or map[XXX]interface{}),
@@ -103,6 +273,9 @@ type DecoderContainerResolver interface {
 	//   - If decoding into a slice, they will be the slice and the index into the slice (an int)
 	//   - Else they will be Invalid/nil
 	// 
+	// length is as read from the stream, and not yet checked against the input: 
+	// a slice returned may be shorter (even empty), and is grown as elements are decoded.
+	// 
 	// Custom code can use this callback to determine how specifically to decode something.
 	// A simple implementation exists which just uses some options to do it 
 	// (see SimpleDecoderContainerResolver).
@@ -144,10 +317,11 @@ type SimpleDecoderContainerResolver struct {
 //    - Lists are always decoded as []interface{}
 //      unless you provide a default slice type when creating your decoder.
 //      option: SliceType
-//    - raw bytes are decoded into []byte or string depending on setting of:
+//    - str (raw bytes) are decoded into []byte or string depending on setting of:
 //      option: BytesStringMapValue     (if within a map value, use this setting)
 //      option: BytesStringSliceElement (else if within a slice, use this setting)
 //      option: BytesStringLiteral      (else use this setting)
+//    - bin is always decoded into []byte
 func (d SimpleDecoderContainerResolver) DecoderContainer(
 	parentcontainer reflect.Value, parentkey interface{}, 
 	length int, ct ContainerType) (rvn reflect.Value) {
@@ -159,11 +333,12 @@ func (d SimpleDecoderContainerResolver) DecoderContainer(
 			rvn = reflect.MakeMap(mapIntfIntfTyp)
 		}
 	case ContainerList:
+		st := intfSliceTyp
 		if d.SliceType != nil {
-			rvn = reflect.MakeSlice(d.SliceType, length, length)
-		} else {
-			rvn = reflect.MakeSlice(intfSliceTyp, length, length)
+			st = d.SliceType
 		}
+		n := decAllocLen(length, st.Elem().Size())
+		rvn = reflect.MakeSlice(st, n, n)
 	case ContainerRawBytes:
 		rk := parentcontainer.Kind()
 		if (rk == reflect.Invalid && d.BytesStringLiteral) ||
@@ -172,24 +347,78 @@ func (d SimpleDecoderContainerResolver) DecoderContainer(
 			rvm := ""
 			rvn = reflect.ValueOf(&rvm)
 		} else {
-			rvn = reflect.MakeSlice(byteSliceTyp, length, length)
+			n := decAllocLen(length, 1)
+			rvn = reflect.MakeSlice(byteSliceTyp, n, n)
 		}
+	case ContainerBinary:
+		n := decAllocLen(length, 1)
+		rvn = reflect.MakeSlice(byteSliceTyp, n, n)
 	}
 	// fmt.Printf("DecoderContainer: %T, %v\n", rvn.Interface(), rvn.Interface())
 	return
 }
 
 // NewDecoder returns a Decoder for decoding a stream of bytes into an object.
-// If nil DecoderContainerResolver is passed, we use DefaultDecoderContainerResolver
+// If nil DecoderContainerResolver is passed, we use DefaultDecoderContainerResolver.
+// It uses DefaultDecoderOptions.
 func NewDecoder(r io.Reader, dam DecoderContainerResolver) (d *Decoder) {
+	return NewDecoderWithOptions(r, dam, nil)
+}
+
+// NewDecoderWithOptions returns a Decoder configured by the given options.
+// If nil DecoderContainerResolver is passed, we use DefaultDecoderContainerResolver.
+// If nil DecoderOptions is passed, we use DefaultDecoderOptions.
+func NewDecoderWithOptions(r io.Reader, dam DecoderContainerResolver, opts *DecoderOptions) (d *Decoder) {
 	if dam == nil {
 		dam = &DefaultDecoderContainerResolver
 	}
-	d = &Decoder{r:r, dam:dam}
+	if opts == nil {
+		opts = &DefaultDecoderOptions
+	}
+	d = &Decoder{r:r, dam:dam, opts:*opts}
 	d.t1, d.t2, d.t4, d.t8 = d.x[:1], d.x[:2], d.x[:4], d.x[:8]
 	return
 }
 
+// NewDecoderBytes returns a Decoder which reads from b directly, 
+// rather than through an io.Reader. Strings are copied from b once, 
+// and with DecoderOptions.AliasInput, []byte values are not copied at all.
+// It uses DefaultDecoderOptions.
+func NewDecoderBytes(b []byte, dam DecoderContainerResolver) (d *Decoder) {
+	return NewDecoderBytesWithOptions(b, dam, nil)
+}
+
+// NewDecoderBytesWithOptions returns a Decoder reading from b, configured by the given options.
+// See NewDecoderBytes and NewDecoderWithOptions.
+func NewDecoderBytesWithOptions(b []byte, dam DecoderContainerResolver, opts *DecoderOptions) (d *Decoder) {
+	d = NewDecoderWithOptions(nil, dam, opts)
+	d.ResetBytes(b)
+	return
+}
+
+// Reset makes d read from r, from the start, so a Decoder (and its internal state) 
+// can be reused for another stream, e.g. from a sync.Pool. It keeps its options 
+// and DecoderContainerResolver. Offsets in errors are counted from the Reset.
+func (d *Decoder) Reset(r io.Reader) {
+	d.reset()
+	d.r = r
+}
+
+// ResetBytes makes d read from b, from the start (see NewDecoderBytes and Reset).
+func (d *Decoder) ResetBytes(b []byte) {
+	d.reset()
+	d.b, d.inBytes, d.inputLen = b, true, int64(len(b))
+}
+
+func (d *Decoder) reset() {
+	for i := range d.path {
+		d.path[i] = decPathElem{} // do not keep map keys alive
+	}
+	d.r, d.b, d.inBytes, d.inputLen = nil, nil, false, 0
+	d.bd, d.bdpos, d.peeked = 0, 0, false
+	d.nread, d.start, d.path = 0, 0, d.path[:0]
+}
+
 // Decode decodes the stream from reader and stores the result in the 
 // value pointed to by v.
 // 
@@ -200,8 +429,22 @@ func NewDecoder(r io.Reader, dam DecoderContainerResolver) (d *Decoder) {
 // If you do not know what type of stream it is, pass in a pointer to a nil interface.
 // We will decode and store a value in that nil interface. 
 // 
+// An extension is decoded into the Go type registered for its type code 
+// (see RegisterExt), or a RawExt if the type code is not registered.
+// 
+// Values implementing Unmarshaler are decoded by calling UnmarshalMsgpack.
+// Else, if enabled in DecoderOptions (as they are by default), a str or bin 
+// in the stream is decoded into values implementing encoding.TextUnmarshaler 
+// or encoding.BinaryUnmarshaler.
+// 
 // time.Time is handled transparently, by (en)decoding (to)from a 
-// []int64{Seconds since Epoch, Nanoseconds offset}.
+// []int64{Seconds since Epoch, Nanoseconds offset}, or the timestamp extension.
+// A timestamp extension decoded into a nil interface{} yields a time.Time (in UTC).
+// 
+// A struct is decoded from a map, or an array of its fields in order (see Encoder.Encode).
+// When decoding a map into a struct, keys which match no field are skipped, 
+// unless DecoderOptions.DisallowUnknownFields is set. Fields whose tag specifies 
+// the "required" option (e.g. `msgpack:"name,required"`) must be present in the map.
 // 
 // Sample usages:
 //   // Decoding into a non-nil typed value
@@ -223,7 +466,8 @@ func (d *Decoder) Decode(v interface{}) (err error) {
 // The reflect.Value must be a pointer.
 // See Decoder.Decode documentation. (Decode internally calls DecodeValue).
 func (d *Decoder) DecodeValue(rv reflect.Value) (err error) {
-	defer panicToErr(&err)
+	defer d.panicToErr(&err)
+	d.begin()
 	// We cannot marshal into a non-pointer or a nil pointer 
 	// (at least pass a nil interface so we can marshal into it)
 	if rv.Kind() != reflect.Ptr || rv.IsNil() {
@@ -241,6 +485,224 @@ func (d *Decoder) DecodeValue(rv reflect.Value) (err error) {
 	return
 }
 
+// ValueType is the type of the next value in the stream, as returned by Decoder.PeekType.
+type ValueType byte
+
+const (
+	ValueInvalid ValueType = iota
+	ValueNil
+	ValueBool
+	ValueInt   // positive and negative fixint, int8/16/32/64
+	ValueUint  // uint8/16/32/64
+	ValueFloat // float32/64
+	ValueStr   // fixstr, str8/16/32 (raw in the original format)
+	ValueBin   // bin8/16/32
+	ValueArray
+	ValueMap
+	ValueExt   // fixext1..16, ext8/16/32 (including timestamps)
+)
+
+var valueTypeNames = [...]string{"Invalid", "Nil", "Bool", "Int", "Uint", "Float", 
+	"Str", "Bin", "Array", "Map", "Ext"}
+
+func (vt ValueType) String() string {
+	if int(vt) < len(valueTypeNames) {
+		return valueTypeNames[vt]
+	}
+	return fmt.Sprintf("ValueType(%d)", byte(vt))
+}
+
+func getValueType(bd byte) (vt ValueType) {
+	switch {
+	case bd <= 0x7f, bd >= 0xe0, bd >= 0xd0 && bd <= 0xd3:
+		vt = ValueInt
+	case bd >= 0xcc && bd <= 0xcf:
+		vt = ValueUint
+	case bd == 0xc0:
+		vt = ValueNil
+	case bd == 0xc2, bd == 0xc3:
+		vt = ValueBool
+	case bd == 0xca, bd == 0xcb:
+		vt = ValueFloat
+	case bd >= 0xa0 && bd <= 0xbf, bd >= 0xd9 && bd <= 0xdb:
+		vt = ValueStr
+	case bd >= 0xc4 && bd <= 0xc6:
+		vt = ValueBin
+	case bd >= 0x90 && bd <= 0x9f, bd == 0xdc, bd == 0xdd:
+		vt = ValueArray
+	case bd >= 0x80 && bd <= 0x8f, bd == 0xde, bd == 0xdf:
+		vt = ValueMap
+	case isExtDesc(bd):
+		vt = ValueExt
+	}
+	return
+}
+
+// The Read methods below read a single token (a primitive value or a container header)
+// from the stream, without reflection. They can be mixed freely with Decode,
+// e.g. to walk a huge array, decoding one element at a time:
+// 
+//   n, err := dec.ReadArrayHeader()
+//   for i := 0; i < n; i++ {
+//       err = dec.Decode(&row)
+//   }
+
+// PeekType returns the type of the next value in the stream, without consuming it.
+func (d *Decoder) PeekType() (vt ValueType, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	if !d.peeked {
+		d.bdpos = d.nread
+		d.readb(1, d.t1)
+		d.bd, d.peeked = d.t1[0], true
+	}
+	if vt = getValueType(d.bd); vt == ValueInvalid {
+		d.errSyntax(d.bd, "PeekType: ")
+	}
+	return
+}
+
+// ReadArrayHeader reads the header of an array, returning its number of elements.
+// The elements must be read (or skipped) next.
+func (d *Decoder) ReadArrayHeader() (n int, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	n = d.readContainerLen(0, true, ContainerList, intfSliceTyp)
+	return
+}
+
+// ReadMapHeader reads the header of a map, returning its number of entries.
+// The keys and values must be read (or skipped) next.
+func (d *Decoder) ReadMapHeader() (n int, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	n = d.readContainerLen(0, true, ContainerMap, mapIntfIntfTyp)
+	return
+}
+
+// ReadInt reads a signed or unsigned integer into an int64.
+func (d *Decoder) ReadInt() (i int64, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	i, _ = d.decodeInteger(d.readDesc(), true, int64Typ)
+	return
+}
+
+// ReadUint reads a non-negative signed or unsigned integer into a uint64.
+func (d *Decoder) ReadUint() (ui uint64, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	_, ui = d.decodeInteger(d.readDesc(), false, uint64Typ)
+	return
+}
+
+// ReadFloat64 reads a float32 or float64.
+func (d *Decoder) ReadFloat64() (f float64, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	switch bd := d.readDesc(); bd {
+	case 0xca:
+		f = float64(math.Float32frombits(d.readUint32()))
+	case 0xcb:
+		f = math.Float64frombits(d.readUint64())
+	default:
+		d.errType(bd, "", float64Typ)
+	}
+	return
+}
+
+// ReadBool reads a bool.
+func (d *Decoder) ReadBool() (b bool, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	switch bd := d.readDesc(); bd {
+	case 0xc2:
+	case 0xc3:
+		b = true
+	default:
+		d.errType(bd, "", boolTyp)
+	}
+	return
+}
+
+// ReadString reads a str (or bin) into a string.
+func (d *Decoder) ReadString() (s string, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	s = string(d.readBytes(stringTyp, true))
+	return
+}
+
+// ReadBytes reads a bin (or str) into a []byte.
+func (d *Decoder) ReadBytes() (bs []byte, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	bs = d.readBytes(byteSliceTyp, d.opts.AliasInput)
+	return
+}
+
+// ReadNil reads a nil. It is an error if the next value is not nil
+// (use PeekType to check first).
+func (d *Decoder) ReadNil() (err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	if bd := d.readDesc(); bd != 0xc0 {
+		d.errType(bd, "", nil)
+	}
+	return
+}
+
+// ReadExt reads an extension, returning its type code and data.
+func (d *Decoder) ReadExt() (xtag int8, data []byte, err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	xtag, data = d.readExt(d.readDesc(), rawExtTyp)
+	return
+}
+
+// Skip reads the next value (walking through arrays and maps) and discards it,
+// without building any Go values.
+func (d *Decoder) Skip() (err error) {
+	defer d.panicToErr(&err)
+	d.begin()
+	d.skipValue(d.readDesc())
+	return
+}
+
+// readBytes reads a bin or str. alias allows returning a slice of the input (see readData).
+func (d *Decoder) readBytes(rt reflect.Type, alias bool) (bs []byte) {
+	l := d.readContainerLen(0, true, ContainerBinary, rt)
+	return d.readData(l, alias)
+}
+
+// setBytesContainer sets the nil interface rv to the DecoderContainer for a 
+// str or bin of length containerLen, returning it to be decoded into. If it is 
+// a []byte shorter than containerLen (see decAllocLen), the bytes are read here.
+func (d *Decoder) setBytesContainer(rv reflect.Value, ct ContainerType, containerLen int) (
+	rvn reflect.Value, handled bool) {
+	rvc := d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct)
+	if rvc.Type() == byteSliceTyp && rvc.Len() < containerLen {
+		rvc, handled = reflect.ValueOf(d.readData(containerLen, false)), true
+	}
+	rv.Set(rvc)
+	return rv.Elem(), handled
+}
+
+// decodesNil reports whether a nil in the stream is passed to the decFn of rv: 
+// for a RawMessage (which keeps its bytes) or an Unmarshaler, as encoding/json does. 
+// Other values, including pointers, are set to their zero value.
+func decodesNil(rv reflect.Value) bool {
+	rt := rv.Type()
+	if rt == rawMessageTyp {
+		return true
+	}
+	if rk := rt.Kind(); rk == reflect.Ptr || rk == reflect.Interface || getExtForType(rt) != nil {
+		return false
+	}
+	_, ok := newDecImpl(rt, unmarshalerTyp).get(rv)
+	return ok
+}
+
 func (d *Decoder) decodeValueT(bd byte, containerLen int, readDesc bool, rve reflect.Value, 
 	checkWasNilIntf bool, dereferencePtr bool, setToRealValue bool) (rvn reflect.Value) {
 	rvn = rve
@@ -262,8 +724,7 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 	rv reflect.Value, bd byte, ct ContainerType, containerLen int, handled bool) {
 	rv, bd, containerLen = rv0, bd0, containerLen0
 	if readDesc {
-		d.readb(1, d.t1)
-		bd = d.t1[0]
+		bd = d.readDesc()
 	}
 	//if we set the reflect.Value to an primitive value, consider it handled and return.
 	handled = true
@@ -297,20 +758,30 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 	case bd == 0xd3:
 		rv.Set(reflect.ValueOf(int64(d.readUint64())))
 
-	case bd == 0xda, bd == 0xdb, bd >= 0xa0 && bd <= 0xbf:
+	case bd == 0xd9, bd == 0xda, bd == 0xdb, bd >= 0xa0 && bd <= 0xbf:
 		ct = ContainerRawBytes
 		if containerLen < 0 {
-			containerLen = d.readContainerLen(bd, false, ct)
+			containerLen = d.readContainerLen(bd, false, ct, nil)
 		}
 		if setContainers {
-			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct))
-			rv = rv.Elem()
+			rv, handled = d.setBytesContainer(rv, ct, containerLen)
+		} else {
+			handled = false
+		}
+	case bd >= 0xc4 && bd <= 0xc6:
+		ct = ContainerBinary
+		if containerLen < 0 {
+			containerLen = d.readContainerLen(bd, false, ct, nil)
+		}
+		if setContainers {
+			rv, handled = d.setBytesContainer(rv, ct, containerLen)
+		} else {
+			handled = false
 		}
-		handled = false
 	case bd == 0xdc, bd == 0xdd, bd >= 0x90 && bd <= 0x9f:
 		ct = ContainerList
 		if containerLen < 0 {
-			containerLen = d.readContainerLen(bd, false, ct)
+			containerLen = d.readContainerLen(bd, false, ct, nil)
 		}
 		if setContainers {
 			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct))
@@ -319,18 +790,29 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 	case bd == 0xde, bd == 0xdf, bd >= 0x80 && bd <= 0x8f:
 		ct = ContainerMap
 		if containerLen < 0 {
-			containerLen = d.readContainerLen(bd, false, ct)
+			containerLen = d.readContainerLen(bd, false, ct, nil)
 		}
 		if setContainers {
 			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct))
 		}
 		handled = false
+	case isExtDesc(bd):
+		xtag, data := d.readExt(bd, nil)
+		if xtag == timeExtTag {
+			rv.Set(reflect.ValueOf(d.decodeTimeExt(data)))
+		} else if xi := getExtForTag(xtag); xi != nil {
+			rvx := reflect.New(xi.rt).Elem()
+			d.decodeExt(xi, data, rvx)
+			rv.Set(rvx)
+		} else {
+			rv.Set(reflect.ValueOf(RawExt{xtag, data}))
+		}
 	case bd >= 0xe0 && bd <= 0xff, bd >= 0x00 && bd <= 0x7f:
 		// FIXNUM
 		rv.Set(reflect.ValueOf(int8(bd)))
 	default:
 		handled = false
-		d.err("Nil-Deciphered DecodeValue: %s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+		d.errSyntax(bd, "Nil-Deciphered DecodeValue: ")
 	}
 	return
 }
@@ -344,8 +826,7 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 	
 	rv = rv0
 	if readDesc {
-		d.readb(1, d.t1)
-		bd = d.t1[0]
+		bd = d.readDesc()
 	}
 
 	rk := rv.Kind()
@@ -362,222 +843,465 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 		rk = rv.Kind()
 	}
 	
-	if bd == 0xc0 {
+	if bd == 0xc0 && !decodesNil(rv) {
 		rv.Set(reflect.Zero(rv.Type()))	
 		//log("==   nil decode: rv: %v, %v", rv, rv.Interface())
 		return
 	}
 	
-	// cases are arranged in sequence of most probable ones
-	switch rk {
-	default:
-		// handles numeral and bool values
-		switch bd {
-		case 0xc2:
-			rv.SetBool(false)
-		case 0xc3:
-			rv.SetBool(true)
-			
-		case 0xca:
-			rv.SetFloat(float64(math.Float32frombits(d.readUint32())))
-		case 0xcb:
-			rv.SetFloat(math.Float64frombits(d.readUint64()))
-			
-		default:
-			d.err("Unhandled single-byte value: %s: %x", msgBadDesc, bd)
+	getDecFn(rv.Type())(d, bd, containerLen, rv)
+	return
+}
+
+// decFn decodes the value with descriptor bd (and containerLen, if already read, else -1)
+// into rv, of the type it was built for (see getDecFn). rv is not a nil interface,
+// and bd is not nil.
+type decFn func(d *Decoder, bd byte, containerLen int, rv reflect.Value)
+
+// decFns caches the decFn of each reflect.Type. It is cleared by RegisterExt.
+var decFns sync.Map
+
+// getDecFn returns the decFn for rt, building it on first use. So the checks 
+// for extensions and unmarshalers, the reflect.Kind switch, and the struct field lookup
+// happen once per type, not for every value.
+func getDecFn(rt reflect.Type) decFn {
+	if fn, ok := decFns.Load(rt); ok {
+		return fn.(decFn)
+	}
+	// decFns do not reference each other (elements go through decodeValue),
+	// so there is no need to handle recursive types as getEncFn does.
+	version := atomic.LoadUint64(&fnsVersion)
+	fn := buildDecFn(rt)
+	storeFn(&decFns, rt, fn, version)
+	return fn
+}
+
+func buildDecFn(rt reflect.Type) decFn {
+	if rt == rawExtTyp {
+		return (*Decoder).decodeRawExt
+	}
+	if rt == rawMessageTyp {
+		return (*Decoder).decodeRawMessage
+	}
+	if xi := getExtForType(rt); xi != nil {
+		return func(d *Decoder, bd byte, containerLen int, rv reflect.Value) {
+			xtag, data := d.readExt(bd, rt)
+			if xtag != xi.tag {
+				d.errType(bd, fmt.Sprintf("Ext %d", xtag), rt)
+			}
+			d.decodeExt(xi, data, rv)
 		}
-	case reflect.String:
-		if containerLen < 0 {
-			containerLen = d.readContainerLen(bd, false, ContainerRawBytes)
+	}
+	fn := buildDecKindFn(rt)
+	if rk := rt.Kind(); rk == reflect.Ptr || rk == reflect.Interface {
+		// pointers and interfaces are checked when we get to their elem
+		return fn
+	}
+	u := newDecImpl(rt, unmarshalerTyp)
+	var bu, tu decImpl
+	// time.Time has its own handling, though it implements both below.
+	if rt != timeTyp {
+		bu, tu = newDecImpl(rt, binaryUnmarshalerTyp), newDecImpl(rt, textUnmarshalerTyp)
+	}
+	if !u.any() && !bu.any() && !tu.any() {
+		return fn
+	}
+	return func(d *Decoder, bd byte, containerLen int, rv reflect.Value) {
+		if rvu, ok := u.get(rv); ok {
+			d.decodeUnmarshaler(bd, rvu)
+		} else if !d.decodeBinaryTextUnmarshaler(bd, containerLen, rv, bu, tu) {
+			fn(d, bd, containerLen, rv)
 		}
-		if containerLen == 0 {
-			break
-		}		
-		bs := make([]byte, containerLen)
-		d.readb(containerLen, bs)
-		rv.SetString(string(bs))
+	}
+}
+
+func buildDecKindFn(rt reflect.Type) decFn {
+	switch rt.Kind() {
+	case reflect.String:
+		return (*Decoder).decodeString
 	case reflect.Slice:
-		rvtype := rv.Type()
-		rawbytes := rvtype == byteSliceTyp
-		
-		if containerLen < 0 {
-			if rawbytes {
-				containerLen = d.readContainerLen(bd, false, ContainerRawBytes)
-			} else {
-				containerLen = d.readContainerLen(bd, false, ContainerList)
-			} 
+		if rt == byteSliceTyp {
+			return (*Decoder).decodeByteSlice
 		}
-		if containerLen == 0 {
-			break
+		elemIsIntf := rt.Elem() == intfTyp
+		return func(d *Decoder, bd byte, containerLen int, rv reflect.Value) {
+			d.decodeSlice(bd, containerLen, rv, elemIsIntf)
 		}
-		
-		if rawbytes {
-			var bs []byte= rv.Bytes()
-			rvlen := len(bs)
-			if rvlen == containerLen {
-			} else if rvlen > containerLen {
-				bs = bs[:containerLen]
-			} else {
-				bs = make([]byte, containerLen)
-				rv.Set(reflect.ValueOf(bs))
-			}
-			d.readb(containerLen, bs)
-			break
+	case reflect.Array:
+		if rt.Len() > 0 && rt.Elem().Kind() == reflect.Uint8 {
+			return (*Decoder).decodeByteArray
 		}
-		
-		if rv.IsNil() {
-			rv.Set(reflect.MakeSlice(rvtype, containerLen, containerLen))
-		} else {
-			rvlen := rv.Len()
-			if containerLen > rv.Cap() {
-				rv2 := reflect.MakeSlice(rvtype, containerLen, containerLen)
-				if rvlen > 0 {
-					reflect.Copy(rv2, rv)
-				}
-				rv.Set(rv2)
-			} else if containerLen > rvlen {
-				rv.SetLen(containerLen)
+		return (*Decoder).decodeArray
+	case reflect.Struct:
+		if rt == timeTyp {
+			return (*Decoder).decodeTime
+		}
+		sis := getStructFieldInfos(rt)
+		return func(d *Decoder, bd byte, containerLen int, rv reflect.Value) {
+			d.decodeStruct(bd, containerLen, rv, sis)
+		}
+	case reflect.Map:
+		return (*Decoder).decodeMap
+	case reflect.Ptr:
+		return func(d *Decoder, bd byte, containerLen int, rv reflect.Value) {
+			if rv.IsNil() {
+				rv.Set(reflect.New(rt.Elem()))
 			}
-		}		
-		d.decodeValuePostList(rv, containerLen, rvtype.Elem() == intfTyp)
-	case reflect.Array:
-		rvtype := rv.Type()
-		rvlen := rv.Len()
-		rawbytes := rvlen > 0 && rv.Index(0).Kind() == reflect.Uint8
-		
-		if containerLen < 0 {
-			if rawbytes {
-				containerLen = d.readContainerLen(bd, false, ContainerRawBytes)
-			} else {
-				containerLen = d.readContainerLen(bd, false, ContainerList)
-			} 
+			d.decodeValue(bd, containerLen, false, rv.Elem())
 		}
-		if containerLen == 0 {
-			break
+	case reflect.Interface:
+		return func(d *Decoder, bd byte, containerLen int, rv reflect.Value) {
+			rve := growable(rv.Elem(), containerLen)
+			d.decodeValue(bd, containerLen, false, rve)
+			if rve.CanSet() {
+				rv.Set(rve)
+			}
 		}
+	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int8, reflect.Int16:
+		return (*Decoder).decodeInt
+	case reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16:
+		return (*Decoder).decodeUint
+	}
+	// handles numeral and bool values
+	return (*Decoder).decodeBoolFloat
+}
+
+func (d *Decoder) decodeRawExt(bd byte, containerLen int, rv reflect.Value) {
+	xtag, data := d.readExt(bd, rawExtTyp)
+	rv.Set(reflect.ValueOf(RawExt{xtag, data}))
+}
+
+// decodeRawMessage does what RawMessage.UnmarshalMsgpack does, 
+// but can alias the input (see DecoderOptions.AliasInput).
+func (d *Decoder) decodeRawMessage(bd byte, containerLen int, rv reflect.Value) {
+	bs := d.readRawValue(bd)
+	if !(d.inBytes && d.opts.AliasInput) {
+		bs = append(rv.Bytes()[:0], bs...)
+	}
+	rv.SetBytes(bs)
+}
+
+func (d *Decoder) decodeBoolFloat(bd byte, containerLen int, rv reflect.Value) {
+	switch bd {
+	case 0xc2:
+		rv.SetBool(false)
+	case 0xc3:
+		rv.SetBool(true)
 		
-		if rawbytes {
-			var bs []byte = rv.Slice(0, rvlen).Bytes()
-			if rvlen == containerLen {
-				d.readb(containerLen, bs)
-			} else if rvlen > containerLen {
-				d.readb(containerLen, bs[:containerLen])
-			} else {
-				d.err("Array len: %d must be >= container Len: %d", rvlen, containerLen)
-			} 
-			break
-		}
+	case 0xca:
+		rv.SetFloat(float64(math.Float32frombits(d.readUint32())))
+	case 0xcb:
+		rv.SetFloat(math.Float64frombits(d.readUint64()))
 		
-		rvelemtype := rvtype.Elem()
-		if rvlen < containerLen {
-			d.err("Array len: %d must be >= container Len: %d", rvlen, containerLen)
-		} else if rvlen > containerLen {
-			for j := containerLen; j < rvlen; j++ {
-				rv.Index(j).Set(reflect.Zero(rvelemtype))
+	default:
+		d.errType(bd, "", rv.Type())
+	}
+}
+
+func (d *Decoder) decodeString(bd byte, containerLen int, rv reflect.Value) {
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerRawBytes, rv.Type())
+	}
+	if containerLen == 0 {
+		return
+	}		
+	rv.SetString(string(d.readData(containerLen, true)))
+}
+
+func (d *Decoder) decodeByteSlice(bd byte, containerLen int, rv reflect.Value) {
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerRawBytes, byteSliceTyp)
+	}
+	if containerLen == 0 {
+		return
+	}
+	if d.inBytes && d.opts.AliasInput {
+		rv.SetBytes(d.readn(containerLen, nil))
+		return
+	}
+	var bs []byte= rv.Bytes()
+	rvlen := len(bs)
+	if rvlen == containerLen {
+	} else if rvlen > containerLen {
+		bs = bs[:containerLen]
+	} else {
+		rv.Set(reflect.ValueOf(d.readData(containerLen, false)))
+		return
+	}
+	d.readb(containerLen, bs)
+}
+
+// decodeSlice decodes a list into the slice rv. If the elements would take more 
+// than decChunkSize, the slice is grown as they are decoded (see decodeValuePostList), 
+// so a corrupt or malicious length cannot make it allocate much more than the input.
+func (d *Decoder) decodeSlice(bd byte, containerLen int, rv reflect.Value, elemIsIntf bool) {
+	rvtype := rv.Type()
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerList, rvtype)
+	}
+	if containerLen == 0 {
+		return
+	}
+	n := decAllocLen(containerLen, rvtype.Elem().Size())
+	if rv.IsNil() {
+		rv.Set(reflect.MakeSlice(rvtype, n, n))
+	} else {
+		rvlen := rv.Len()
+		if containerLen > rv.Cap() {
+			if n > rvlen {
+				rv2 := reflect.MakeSlice(rvtype, n, n)
+				reflect.Copy(rv2, rv)
+				rv.Set(rv2)
 			}
+		} else if containerLen > rvlen {
+			rv.SetLen(containerLen)
 		}
-		d.decodeValuePostList(rv, containerLen, rvelemtype == intfTyp)
-	case reflect.Struct:
-		rvtype := rv.Type()
-		if rvtype == timeTyp {
-			tt := [2]int64{}
-			d.decodeValue(bd, -1, false, reflect.ValueOf(&tt).Elem())
-			rv.Set(reflect.ValueOf(time.Unix(tt[0], tt[1]).UTC()))
-			break
+	}		
+	d.decodeValuePostList(rv, containerLen, elemIsIntf)
+}
+
+// decAllocLen returns how many of containerLen elements of elemSize bytes to allocate 
+// before decoding them: all of them, unless they take more than decChunkSize, 
+// in which case none are, and they are allocated as they are decoded.
+func decAllocLen(containerLen int, elemSize uintptr) int {
+	if elemSize == 0 || uintptr(containerLen) <= decChunkSize / elemSize {
+		return containerLen
+	}
+	return 0
+}
+
+// growSlice makes the settable slice rv (shorter than containerLen) longer, 
+// doubling it up to containerLen.
+func growSlice(rv reflect.Value, containerLen int) {
+	rvlen := rv.Len()
+	n := 2 * rvlen
+	if n < 8 {
+		n = 8
+	}
+	if n > containerLen {
+		n = containerLen
+	}
+	if n <= rv.Cap() {
+		rv.SetLen(n)
+		return
+	}
+	rv2 := reflect.MakeSlice(rv.Type(), n, n)
+	reflect.Copy(rv2, rv)
+	rv.Set(rv2)
+}
+
+// growable returns rv, or if it is a slice shorter than containerLen (e.g. from a 
+// DecoderContainerResolver, or in an interface{}), a settable copy of it, 
+// so decoding into it can grow it.
+func growable(rv reflect.Value, containerLen int) reflect.Value {
+	if rv.Kind() != reflect.Slice || rv.Len() >= containerLen || rv.CanSet() {
+		return rv
+	}
+	rv2 := reflect.New(rv.Type()).Elem()
+	rv2.Set(rv)
+	return rv2
+}
+
+func (d *Decoder) decodeByteArray(bd byte, containerLen int, rv reflect.Value) {
+	rvlen := rv.Len()
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerRawBytes, rv.Type())
+	}
+	if containerLen == 0 {
+		return
+	}
+	var bs []byte = rv.Slice(0, rvlen).Bytes()
+	if rvlen == containerLen {
+		d.readb(containerLen, bs)
+	} else if rvlen > containerLen {
+		d.readb(containerLen, bs[:containerLen])
+	} else {
+		d.errType(bd, fmt.Sprintf("%v of length %d", getValueType(bd), containerLen), rv.Type())
+	} 
+}
+
+func (d *Decoder) decodeArray(bd byte, containerLen int, rv reflect.Value) {
+	rvtype := rv.Type()
+	rvlen := rv.Len()
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerList, rvtype)
+	}
+	if containerLen == 0 {
+		return
+	}
+	rvelemtype := rvtype.Elem()
+	if rvlen < containerLen {
+		d.errType(bd, fmt.Sprintf("%v of length %d", getValueType(bd), containerLen), rvtype)
+	} else if rvlen > containerLen {
+		for j := containerLen; j < rvlen; j++ {
+			rv.Index(j).Set(reflect.Zero(rvelemtype))
 		}
+	}
+	d.decodeValuePostList(rv, containerLen, rvelemtype == intfTyp)
+}
+
+func (d *Decoder) decodeTime(bd byte, containerLen int, rv reflect.Value) {
+	if isExtDesc(bd) {
+		rv.Set(reflect.ValueOf(d.readTimeExt(bd)))
+		return
+	}
+	tt := [2]int64{}
+	d.decodeValue(bd, -1, false, reflect.ValueOf(&tt).Elem())
+	rv.Set(reflect.ValueOf(time.Unix(tt[0], tt[1]).UTC()))
+}
+
+func (d *Decoder) decodeMap(bd byte, containerLen int, rv reflect.Value) {
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerMap, rv.Type())
+	}
+	if containerLen == 0 {
+		return
+	}
+	rvtype := rv.Type()
+	ktype, vtype := rvtype.Key(), rvtype.Elem()			
+	if rv.IsNil() {
+		rvn := reflect.MakeMap(rvtype)
+		rv.Set(rvn)
+	}
+	pi := d.enterContainer('k')
+	for j := 0; j < containerLen; j++ {
+		rvk := reflect.New(ktype).Elem()
+		d.path[pi].key = reflect.Value{}
+		rvk = d.decodeValueT(0, -1, true, rvk, true, true, false)
 		
-		if containerLen < 0 {
-			containerLen = d.readContainerLen(bd, false, ContainerMap)
-		}
-		if containerLen == 0 {
-			break
-		}
-		for j := 0; j < containerLen; j++ {
-			rvkencname := ""
-			rvk := reflect.ValueOf(&rvkencname).Elem()
-			d.decodeValue(0, -1, true, rvk)
-			rvksi := getStructFieldInfos(rvtype).getForEncName(rvkencname)
-			if rvksi == nil {
-				// d.err("DecodeValue: Invalid Enc Field: %s", rvkencname) (skip it)
-				var nilintf0 interface{}
-				d.decodeValueT(0, -1, true, reflect.ValueOf(&nilintf0), true, true, true)
-			} else {
-				d.decodeValueT(0, -1, true, rvksi.field(rv), true, true, true)
-			}
+		if ktype == intfTyp && rvk.Type() == byteSliceTyp {
+			rvk = reflect.ValueOf(string(rvk.Bytes()))
 		}
-	case reflect.Map:
-		if containerLen < 0 {
-			containerLen = d.readContainerLen(bd, false, ContainerMap)
-		}
-		if containerLen == 0 {
-			break
-		}
-		rvtype := rv.Type()
-		ktype, vtype := rvtype.Key(), rvtype.Elem()			
-		if rv.IsNil() {
-			rvn := reflect.MakeMap(rvtype)
-			rv.Set(rvn)
-		}
-		for j := 0; j < containerLen; j++ {
-			rvk := reflect.New(ktype).Elem()
-			rvk = d.decodeValueT(0, -1, true, rvk, true, true, false)
-			
-			if ktype == intfTyp && rvk.Type() == byteSliceTyp {
-				rvk = reflect.ValueOf(string(rvk.Bytes()))
+		d.path[pi].key = rvk
+		rvv := rv.MapIndex(rvk)
+		if !rvv.IsValid() {
+			rvv = reflect.New(vtype).Elem()
+		}
+		if vtype == intfTyp && rvv.IsNil() {
+			rvv, bd0, ct0, containerLen0, handled0 := d.nilIntfDecode(0, -1, true, false, rvv)
+			if !handled0 {
+				if rvv2 := d.dam.DecoderContainer(rv, rvk, containerLen0, ct0); rvv2.IsValid() {
+					rvv2 = d.decodeValueT(bd0, containerLen0, false, growable(rvv2, containerLen0), false, true, false)
+					rvv.Set(rvv2)
+				} else {
+					rvv = d.decodeValueT(bd0, containerLen0, false, rvv, true, true, false)
+				}
 			}
-			rvv := rv.MapIndex(rvk)
-			if !rvv.IsValid() {
-				rvv = reflect.New(vtype).Elem()
+		} else {
+			rvv = d.decodeValueT(0, -1, true, rvv, true, true, false)
+		}
+		rv.SetMapIndex(rvk, rvv)
+	}
+	d.exitContainer()
+}
+
+func (d *Decoder) decodeInt(bd byte, containerLen int, rv reflect.Value) {
+	i, _ := d.decodeInteger(bd, true, rv.Type())
+	if rv.OverflowInt(i) {
+		d.errType(bd, fmt.Sprintf("%v %d", getValueType(bd), i), rv.Type())
+	} else {
+		rv.SetInt(i)
+	}
+}
+
+func (d *Decoder) decodeUint(bd byte, containerLen int, rv reflect.Value) {
+	_, ui := d.decodeInteger(bd, false, rv.Type())
+	if rv.OverflowUint(ui) {
+		d.errType(bd, fmt.Sprintf("%v %d", getValueType(bd), ui), rv.Type())
+	} else {
+		rv.SetUint(ui)
+	}
+}
+
+// decodeStruct decodes a map (keyed by field encode names) or an array 
+// (in field order, as written in toarray mode) into the struct rv.
+func (d *Decoder) decodeStruct(bd byte, containerLen int, rv reflect.Value, sis *structFieldInfos) {
+	rvtype := rv.Type()
+	isArray := getValueType(bd) == ValueArray
+	if containerLen < 0 {
+		if isArray {
+			containerLen = d.readContainerLen(bd, false, ContainerList, rvtype)
+		} else {
+			containerLen = d.readContainerLen(bd, false, ContainerMap, rvtype)
+		}
+	}
+	if containerLen == 0 && sis.numRequired == 0 {
+		return
+	}
+	var seen []bool // fields found in the stream, if some are required
+	if sis.numRequired > 0 {
+		seen = make([]bool, len(sis.sis))
+	}
+	pi := d.enterContainer('f')
+	for j := 0; j < containerLen; j++ {
+		k := j
+		var rvkencname string
+		if isArray {
+			if k >= len(sis.sis) {
+				k = -1
+				rvkencname = fmt.Sprintf("[%d]", j)
 			}
-			if vtype == intfTyp && rvv.IsNil() {
-				rvv, bd0, ct0, containerLen0, handled0 := d.nilIntfDecode(0, -1, true, false, rvv)
-				if !handled0 {
-					if rvv2 := d.dam.DecoderContainer(rv, rvk, containerLen0, ct0); rvv2.IsValid() {
-						rvv2 = d.decodeValueT(bd0, containerLen0, false, rvv2, false, true, false)
-						rvv.Set(rvv2)
-					} else {
-						rvv = d.decodeValueT(bd0, containerLen0, false, rvv, true, true, false)
-					}
+		} else {
+			d.path[pi].field = ""
+			// keys are strs, or integers for fields with an integer key name
+			if bdk := d.readDesc(); bdk == 0xcf {
+				// a uint64 above MaxInt64 matches no (int64) key
+				_, uk := d.decodeInteger(bdk, false, uint64Typ)
+				if k = -1; uk <= math.MaxInt64 {
+					k = sis.indexForIntKey(int64(uk))
+				}
+				if k == -1 {
+					rvkencname = strconv.FormatUint(uk, 10)
+				}
+			} else if bdk <= 0x7f || bdk >= 0xe0 || (bdk >= 0xcc && bdk <= 0xd3) {
+				ik, _ := d.decodeInteger(bdk, true, int64Typ)
+				if k = sis.indexForIntKey(ik); k == -1 {
+					rvkencname = strconv.FormatInt(ik, 10)
 				}
 			} else {
-				rvv = d.decodeValueT(0, -1, true, rvv, true, true, false)
+				rvk := reflect.ValueOf(&rvkencname).Elem()
+				d.decodeValue(bdk, -1, false, rvk)
+				k = sis.indexForEncName(rvkencname)
 			}
-			rv.SetMapIndex(rvk, rvv)
-		}
-	case reflect.Ptr:
-		if rv.IsNil() {
-			rv.Set(reflect.New(rv.Type().Elem()))
 		}
-		d.decodeValue(bd, containerLen, false, rv.Elem())
-	case reflect.Interface:
-		d.decodeValue(bd, containerLen, false, rv.Elem())
-	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int8, reflect.Int16:
-		i, _ := d.decodeInteger(bd, true)
-		if rv.OverflowInt(i) {
-			d.err("Overflow int value: %v into kind: %v", i, rk)
+		if k == -1 {
+			d.path[pi].field = rvkencname
+			if d.opts.DisallowUnknownFields {
+				panic(&UnknownFieldError{rvkencname, rvtype})
+			}
+			d.skipValue(d.readDesc())
 		} else {
-			rv.SetInt(i)
+			rvksi := sis.sis[k]
+			if seen != nil {
+				seen[k] = true
+			}
+			d.path[pi].field = rvksi.name
+			d.decodeValueT(0, -1, true, rvksi.field(rv), true, true, true)
 		}
-	case reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16:
-		_, ui := d.decodeInteger(bd, false)
-		if rv.OverflowUint(ui) {
-			d.err("Overflow unsigned int value: %v into kind: %v", ui, rk)
-		} else {
-			rv.SetUint(ui)
+	}
+	d.path[pi].field = ""
+	for k, ok := range seen {
+		if !ok && sis.sis[k].required {
+			panic(&MissingFieldError{sis.sis[k].encName, rvtype})
 		}
 	}
-	return
+	d.exitContainer()
 }
 
 func (d *Decoder) decodeValuePostList(rv reflect.Value, containerLen int, elemIsIntf bool) {
+	pi := d.enterContainer('i')
 	for j := 0; j < containerLen; j++ {
+		d.path[pi].index = j
+		if j == rv.Len() {
+			growSlice(rv, containerLen)
+		}
 		rvj := rv.Index(j)
 		if elemIsIntf && rvj.IsNil() {
 			rvj, bd0, ct0, containerLen0, handled0 := d.nilIntfDecode(0, -1, true, false, rvj)
 			// fmt.Printf("intfTyp: %v, %v, %v, %v, %v\n", rvj.Interface(), bd0, ct0, containerLen0, handled0)
 			if !handled0 {
 				if rvj2 := d.dam.DecoderContainer(rv, j, containerLen0, ct0); rvj2.IsValid() {
-					rvj2 = d.decodeValueT(bd0, containerLen0, false, rvj2, false, true, false)
+					rvj2 = d.decodeValueT(bd0, containerLen0, false, growable(rvj2, containerLen0), false, true, false)
 					rvj.Set(rvj2)
 				} else {
 					d.decodeValueT(bd0, containerLen0, false, rvj, true, true, true)
@@ -587,10 +1311,12 @@ func (d *Decoder) decodeValuePostList(rv reflect.Value, containerLen int, elemIs
 			d.decodeValueT(0, -1, true, rvj, true, true, true)
 		}
 	}
+	d.exitContainer()
 }
 	
 // decode an integer from the stream
-func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
+// rt is the Go type being decoded into (for errors).
+func (d *Decoder) decodeInteger(bd byte, sign bool, rt reflect.Type) (i int64, ui uint64) {
 	switch {
 	case bd == 0xcc:
 		ui = uint64(d.readUint8())
@@ -610,6 +1336,9 @@ func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 	case bd == 0xcf:
 		ui = d.readUint64()
 		if sign {
+			if ui > math.MaxInt64 {
+				d.errType(bd, fmt.Sprintf("Uint %d", ui), rt)
+			}
 			i = int64(ui)
 		}
 
@@ -619,7 +1348,7 @@ func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 			if i >= 0 {
 				ui = uint64(i)
 			} else {
-				d.err("Assigning negative signed value: %v, to unsigned type", i)
+				d.errType(bd, fmt.Sprintf("Int %d", i), rt)
 			}
 		}
 	case bd == 0xd1:
@@ -628,7 +1357,7 @@ func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 			if i >= 0 {
 				ui = uint64(i)
 			} else {
-				d.err("Assigning negative signed value: %v, to unsigned type", i)
+				d.errType(bd, fmt.Sprintf("Int %d", i), rt)
 			}
 		}
 	case bd == 0xd2:
@@ -637,7 +1366,7 @@ func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 			if i >= 0 {
 				ui = uint64(i)
 			} else {
-				d.err("Assigning negative signed value: %v, to unsigned type", i)
+				d.errType(bd, fmt.Sprintf("Int %d", i), rt)
 			}
 		}
 	case bd == 0xd3:
@@ -646,7 +1375,7 @@ func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 			if i >= 0 {
 				ui = uint64(i)
 			} else {
-				d.err("Assigning negative signed value: %v, to unsigned type", i)
+				d.errType(bd, fmt.Sprintf("Int %d", i), rt)
 			}
 		}
 
@@ -659,67 +1388,491 @@ func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 	case bd >= 0xe0 && bd <= 0xff:
 		i = int64(int8(bd))
 		if !sign {
-			d.err("Assigning negative signed value: %v, to unsigned type", i)
+			d.errType(bd, fmt.Sprintf("Int %d", i), rt)
+		}
+	default:
+		d.errType(bd, "", rt)
+	}
+	return
+}
+
+func (d *Decoder) decodeUnmarshaler(bd byte, rv reflect.Value) {
+	if err := rv.Interface().(Unmarshaler).UnmarshalMsgpack(d.readRawValue(bd)); err != nil {
+		d.err("Error calling UnmarshalMsgpack for type: %v: %w", rv.Type(), err)
+	}
+}
+
+// decodeBinaryTextUnmarshaler decodes a str or bin in the stream using 
+// encoding.BinaryUnmarshaler or encoding.TextUnmarshaler (if enabled in options).
+// bu and tu record whether rv implements them.
+// It returns false if the stream has neither, or rv implements neither.
+func (d *Decoder) decodeBinaryTextUnmarshaler(bd byte, containerLen int, rv reflect.Value, bu, tu decImpl) bool {
+	isBin := bd >= 0xc4 && bd <= 0xc6
+	isStr := (bd >= 0xa0 && bd <= 0xbf) || (bd >= 0xd9 && bd <= 0xdb)
+	if !isBin && !isStr {
+		return false
+	}
+	var rvu reflect.Value
+	var ok, text bool
+	if isStr && d.opts.TextUnmarshaler {
+		rvu, text = tu.get(rv)
+		ok = text
+	}
+	if !ok && d.opts.BinaryUnmarshaler {
+		rvu, ok = bu.get(rv)
+	}
+	if !ok {
+		return false
+	}
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerRawBytes, rv.Type())
+	}
+	// Like Unmarshaler, these must copy the data to retain it.
+	bs := d.readData(containerLen, true)
+	var err error
+	if text {
+		err = rvu.Interface().(encoding.TextUnmarshaler).UnmarshalText(bs)
+	} else {
+		err = rvu.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(bs)
+	}
+	if err != nil {
+		d.err("Error unmarshalling str/bin into type: %v: %w", rvu.Type(), err)
+	}
+	return true
+}
+
+// readRawValue returns the bytes of the next value in the stream, 
+// whose descriptor bd has already been read. 
+// If reading from a []byte, they are a slice of the input.
+func (d *Decoder) readRawValue(bd byte) (bs []byte) {
+	if d.inBytes {
+		start := d.bdpos
+		d.walkValue(bd, nil)
+		return d.b[start:d.nread:d.nread]
+	}
+	d.walkValue(bd, &bs)
+	return
+}
+
+// skipValue reads and discards the next value in the stream, 
+// whose descriptor bd has already been read. It does not allocate.
+func (d *Decoder) skipValue(bd byte) {
+	d.walkValue(bd, nil)
+}
+
+// walkValue walks the next value in the stream (whose descriptor bd has already been read),
+// through arrays and maps, to find its end. It does not interpret anything else.
+// The bytes read are appended to *bs, or discarded if bs is nil.
+func (d *Decoder) walkValue(bd byte, bs *[]byte) {
+	keep := func(b []byte) {
+		if bs != nil {
+			*bs = append(*bs, b...)
+		}
+	}
+	d.t1[0] = bd
+	keep(d.t1)
+	for remaining, first := 1, true; remaining > 0; remaining, first = remaining - 1, false {
+		if !first {
+			bd = d.readDesc()
+			d.t1[0] = bd
+			keep(d.t1)
+		}
+		var l int // number of data bytes following the descriptor (and length)
+		var n int // number of values contained (for arrays and maps)
+		switch {
+		case bd <= 0x7f, bd >= 0xe0, bd == 0xc0, bd == 0xc2, bd == 0xc3:
+		case bd == 0xcc, bd == 0xd0:
+			l = 1
+		case bd == 0xcd, bd == 0xd1:
+			l = 2
+		case bd == 0xca, bd == 0xce, bd == 0xd2:
+			l = 4
+		case bd == 0xcb, bd == 0xcf, bd == 0xd3:
+			l = 8
+		case bd >= 0xa0 && bd <= 0xbf:
+			l = int(bd & 0x1f)
+			d.checkLen(ContainerBinary, l)
+		case bd == 0xd9, bd == 0xc4:
+			l = int(d.readUint8())
+			keep(d.t1)
+			d.checkLen(ContainerBinary, l)
+		case bd == 0xda, bd == 0xc5:
+			l = int(d.readUint16())
+			keep(d.t2)
+			d.checkLen(ContainerBinary, l)
+		case bd == 0xdb, bd == 0xc6:
+			l = int(d.readUint32())
+			keep(d.t4)
+			d.checkLen(ContainerBinary, l)
+		case bd >= 0x90 && bd <= 0x9f:
+			n = int(bd & 0x0f)
+			d.checkLen(ContainerList, n)
+		case bd == 0xdc:
+			n = int(d.readUint16())
+			keep(d.t2)
+			d.checkLen(ContainerList, n)
+		case bd == 0xdd:
+			n = int(d.readUint32())
+			keep(d.t4)
+			d.checkLen(ContainerList, n)
+		case bd >= 0x80 && bd <= 0x8f:
+			n = int(bd & 0x0f)
+			d.checkLen(ContainerMap, n)
+			n *= 2
+		case bd == 0xde:
+			n = int(d.readUint16())
+			keep(d.t2)
+			d.checkLen(ContainerMap, n)
+			n *= 2
+		case bd == 0xdf:
+			n = int(d.readUint32())
+			keep(d.t4)
+			d.checkLen(ContainerMap, n)
+			n *= 2
+		case bd >= 0xd4 && bd <= 0xd8:
+			l = 1 + (1 << (bd - 0xd4)) // type code and data
+		case bd == 0xc7:
+			l = int(d.readUint8())
+			keep(d.t1)
+			d.checkLen(ContainerBinary, l)
+			l++ // type code
+		case bd == 0xc8:
+			l = int(d.readUint16())
+			keep(d.t2)
+			d.checkLen(ContainerBinary, l)
+			l++
+		case bd == 0xc9:
+			l = int(d.readUint32())
+			keep(d.t4)
+			d.checkLen(ContainerBinary, l)
+			l++
+		default:
+			d.errSyntax(bd, "walkValue: ")
+		}
+		remaining += n
+		if l == 0 {
+			continue
 		}
+		if bs != nil {
+			*bs = d.appendn(*bs, l)
+		} else {
+			d.discard(l)
+		}
+	}
+}
+
+// discard reads and discards n bytes, using a scratch buffer kept on the Decoder.
+func (d *Decoder) discard(n int) {
+	if d.inBytes {
+		d.readn(n, nil)
+		return
+	}
+	if d.skipbuf == nil {
+		d.skipbuf = make([]byte, 512)
+	}
+	for n > 0 {
+		m := n
+		if m > len(d.skipbuf) {
+			m = len(d.skipbuf)
+		}
+		d.readb(m, d.skipbuf[:m])
+		n -= m
+	}
+}
+
+func isExtDesc(bd byte) bool {
+	return (bd >= 0xd4 && bd <= 0xd8) || (bd >= 0xc7 && bd <= 0xc9)
+}
+
+// readExt reads the type code and data of an extension, given its descriptor bd.
+// rt is the Go type being decoded into (for errors).
+func (d *Decoder) readExt(bd byte, rt reflect.Type) (xtag int8, data []byte) {
+	var l int
+	switch bd {
+	case 0xd4:
+		l = 1
+	case 0xd5:
+		l = 2
+	case 0xd6:
+		l = 4
+	case 0xd7:
+		l = 8
+	case 0xd8:
+		l = 16
+	case 0xc7:
+		l = int(d.readUint8())
+	case 0xc8:
+		l = int(d.readUint16())
+	case 0xc9:
+		l = int(d.readUint32())
 	default:
-		d.err("Unhandled single-byte unsigned integer value: %s: %x", msgBadDesc, bd)
+		d.errType(bd, "", rt)
+	}
+	d.checkLen(ContainerBinary, l)
+	xtag = int8(d.readUint8())
+	data = d.readData(l, false)
+	return
+}
+
+func (d *Decoder) readTimeExt(bd byte) time.Time {
+	xtag, data := d.readExt(bd, timeTyp)
+	if xtag != timeExtTag {
+		d.errType(bd, fmt.Sprintf("Ext %d", xtag), timeTyp)
+	}
+	return d.decodeTimeExt(data)
+}
+
+func (d *Decoder) decodeTimeExt(data []byte) time.Time {
+	tt, err := decodeTimeExt(data)
+	if err != nil {
+		d.err("Error decoding time: %w", err)
+	}
+	return tt
+}
+
+func (d *Decoder) decodeExt(xi *extInfo, data []byte, rv reflect.Value) {
+	if err := xi.decFn(rv, data); err != nil {
+		d.err("Error decoding extension: %v: %w", xi.rt, err)
+	}
+}
+
+// begin is called at the start of each exported method which reads from the stream.
+func (d *Decoder) begin() {
+	d.start, d.path = d.nread, d.path[:0]
+	if d.peeked {
+		// the value starts at the descriptor read by PeekType
+		d.start = d.bdpos
+	}
+}
+
+// enterContainer is called before decoding the elements of an array or map (or struct).
+// It returns the index in d.path of the element to update with each array index, 
+// map key or struct field.
+func (d *Decoder) enterContainer(kind byte) (pi int) {
+	pi = len(d.path)
+	if d.opts.MaxDepth > 0 && pi >= d.opts.MaxDepth {
+		panic(&LimitError{"MaxDepth", int64(d.opts.MaxDepth), int64(pi + 1)})
+	}
+	d.path = append(d.path, decPathElem{kind: kind})
+	return
+}
+
+func (d *Decoder) exitContainer() {
+	d.path = d.path[:len(d.path)-1]
+}
+
+// pathString formats d.path, e.g. Orders[3].Items["sku"].Qty
+func (d *Decoder) pathString() string {
+	var buf bytes.Buffer
+	for _, pe := range d.path {
+		switch pe.kind {
+		case 'i':
+			fmt.Fprintf(&buf, "[%d]", pe.index)
+		case 'f':
+			if pe.field == "" {
+				break
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('.')
+			}
+			buf.WriteString(pe.field)
+		case 'k':
+			if !pe.key.IsValid() || !pe.key.CanInterface() {
+				break
+			}
+			if s, ok := pe.key.Interface().(string); ok {
+				fmt.Fprintf(&buf, "[%q]", s)
+			} else {
+				fmt.Fprintf(&buf, "[%v]", pe.key.Interface())
+			}
+		}
+	}
+	return buf.String()
+}
+
+// panicToErr is used (deferred) by the exported methods instead of panicToErr.
+// It wraps the error in a *DecodeError (see there).
+func (d *Decoder) panicToErr(err *error) {
+	if x := recover(); x != nil {
+		panicToErrT(x, err)
+		if *err == io.EOF {
+			if d.nread == d.start {
+				return
+			}
+			*err = io.ErrUnexpectedEOF
+		}
+		*err = &DecodeError{Offset: d.bdpos, Desc: d.bd, Path: d.pathString(), Err: *err}
+	}
+}
+
+// checkLen checks a length read from the stream against the limits in DecoderOptions
+// and the length of the input, before anything is allocated for it.
+func (d *Decoder) checkLen(ct ContainerType, l int) {
+	max, limit, minBytes := d.opts.MaxStringLen, "MaxStringLen", int64(l)
+	switch ct {
+	case ContainerList:
+		max, limit = d.opts.MaxContainerLen, "MaxContainerLen"
+	case ContainerMap:
+		max, limit, minBytes = d.opts.MaxContainerLen, "MaxContainerLen", 2 * int64(l)
+	}
+	if max == 0 && !d.inBytes {
+		max = StreamMaxStringLen
+		if ct == ContainerList || ct == ContainerMap {
+			max = StreamMaxContainerLen
+		}
+	}
+	if max > 0 && l > max {
+		panic(&LimitError{limit, int64(max), int64(l)})
+	}
+	// each element takes at least 1 byte in the stream.
+	if d.opts.MaxBytes > 0 && d.nread - d.start + minBytes > d.opts.MaxBytes {
+		panic(&LimitError{"MaxBytes", d.opts.MaxBytes, d.nread - d.start + minBytes})
+	}
+	if d.inputLen > 0 && d.nread + minBytes > d.inputLen {
+		panic(io.ErrUnexpectedEOF)
+	}
+}
+
+// readDesc reads the next descriptor byte, which may have been read ahead by PeekType.
+func (d *Decoder) readDesc() byte {
+	if d.peeked {
+		d.peeked = false
+		return d.bd
+	}
+	d.bdpos = d.nread
+	d.bd = d.readn(1, d.t1)[0]
+	return d.bd
+}
+
+// readn reads n bytes. If reading from a []byte, it returns a slice of the input 
+// (with no spare capacity), without copying. Else it reads into bs (of length n).
+func (d *Decoder) readn(n int, bs []byte) []byte {
+	if !d.inBytes {
+		d.readb(n, bs)
+		return bs
+	}
+	d.checkMaxBytes(n)
+	i := int(d.nread)
+	if len(d.b) - i < n {
+		d.nread = int64(len(d.b))
+		if len(d.b) == i {
+			panic(io.EOF)
+		}
+		panic(io.ErrUnexpectedEOF)
+	}
+	d.nread += int64(n)
+	return d.b[i:i+n:i+n]
+}
+
+// readData returns the next n bytes. If alias is set (e.g. they are copied by 
+// the caller anyway), it may return a slice of the input (see readn). 
+// Else it returns a new []byte.
+func (d *Decoder) readData(n int, alias bool) (bs []byte) {
+	if alias && d.inBytes {
+		return d.readn(n, nil)
+	}
+	if n > decChunkSize && !d.inBytes && d.inputLen == 0 {
+		return d.appendn(make([]byte, 0, decChunkSize), n)
+	}
+	bs = make([]byte, n)
+	if n > 0 {
+		d.readb(n, bs)
 	}
 	return
 }
 
+// decChunkSize is the most appendn allocates ahead of the bytes actually read 
+// from a stream of unknown length.
+const decChunkSize = 64 * 1024
+
+// appendn reads n bytes, appending them to bs. If the length of the input is unknown, 
+// bs is grown as bytes arrive, so a corrupt or malicious length in the stream 
+// cannot make it allocate much more than is actually read.
+func (d *Decoder) appendn(bs []byte, n int) []byte {
+	for n > 0 {
+		m := n
+		if m > decChunkSize && !d.inBytes && d.inputLen == 0 {
+			m = decChunkSize
+		}
+		l := len(bs)
+		bs = append(bs, make([]byte, m)...)
+		d.readb(m, bs[l:])
+		n -= m
+	}
+	return bs
+}
+
+func (d *Decoder) checkMaxBytes(numbytes int) {
+	if d.opts.MaxBytes > 0 && d.nread - d.start + int64(numbytes) > d.opts.MaxBytes {
+		panic(&LimitError{"MaxBytes", d.opts.MaxBytes, d.nread - d.start + int64(numbytes)})
+	}
+}
+
 // read a number of bytes into bs
 func (d *Decoder) readb(numbytes int, bs []byte) {
+	if d.inBytes {
+		copy(bs, d.readn(numbytes, nil))
+		return
+	}
+	d.checkMaxBytes(numbytes)
 	n, err := io.ReadAtLeast(d.r, bs, numbytes) 
+	d.nread += int64(n)
 	if err != nil {
-		// propagage io.EOF upwards (it's special, and must be returned AS IS)
-		if err == io.EOF {
-			panic(err)
-		} else {
-			d.err("Error: %v", err)
-		}
+		// propagage io.EOF upwards (it's special, and must be returned AS IS at 
+		// the start of a value). The error is wrapped by panicToErr.
+		panic(err)
 	} else if n != numbytes {
 		d.err("read: Incorrect num bytes read. Expecting: %v, Received: %v", numbytes, n)
 	}
 }
 
+// The readUintXXX methods read into d.tX when reading from an io.Reader 
+// (walkValue relies on this).
 func (d *Decoder) readUint8() uint8 {
-	d.readb(1, d.t1)
-	return d.t1[0]
+	return d.readn(1, d.t1)[0]
 }
 
 func (d *Decoder) readUint16() uint16 {
-	d.readb(2, d.t2)
-	return binary.BigEndian.Uint16(d.t2)
+	return binary.BigEndian.Uint16(d.readn(2, d.t2))
 }
 
 func (d *Decoder) readUint32() uint32 {
-	d.readb(4, d.t4)
-	return binary.BigEndian.Uint32(d.t4)
+	return binary.BigEndian.Uint32(d.readn(4, d.t4))
 }
 
 func (d *Decoder) readUint64() uint64 {
-	d.readb(8, d.t8)
-	return binary.BigEndian.Uint64(d.t8)
+	return binary.BigEndian.Uint64(d.readn(8, d.t8))
 }
 
-func (d *Decoder) readContainerLen(bd byte, readDesc bool, ct ContainerType) (l int) {
+// rt is the Go type being decoded into (for errors).
+func (d *Decoder) readContainerLen(bd byte, readDesc bool, ct ContainerType, rt reflect.Type) (l int) {
 	// bd is the byte descriptor. First byte is always descriptive.
 	if readDesc {
-		d.readb(1, d.t1)
-		bd = d.t1[0]
+		bd = d.readDesc()
 	}
-	_, b0, b1, b2 := getContainerByteDesc(ct)
+	// str and bin are interchangeable when decoding into a string or []byte.
+	if ct == ContainerRawBytes || ct == ContainerBinary {
+		if bd >= 0xc4 && bd <= 0xc6 {
+			ct = ContainerBinary
+		} else {
+			ct = ContainerRawBytes
+		}
+	}
+	cutoff, b0, b8, b16, b32 := getContainerByteDesc(ct)
 
 	switch {
-	case bd == b1:
+	case b8 != 0 && bd == b8:
+		l = int(d.readUint8())
+	case bd == b16:
 		l = int(d.readUint16())
-	case bd == b2:
+	case bd == b32:
 		l = int(d.readUint32())
-	case (b0 & bd) == b0:
-		l = int(b0 ^ bd)
+	case cutoff > 0 && bd >= b0 && bd < b0 + byte(cutoff):
+		l = int(bd - b0)
 	default:
-		d.err("readContainerLen: %s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+		d.errType(bd, "", rt)
 	}
+	d.checkLen(ct, l)
 	return	
 }
 
@@ -727,8 +1880,45 @@ func (d *Decoder) err(format string, params ...interface{}) {
 	doPanic(msgTagDec, format, params)
 }
 
+func (d *Decoder) errSyntax(bd byte, context string) {
+	panic(&SyntaxError{Offset: d.bdpos, Desc: bd, Msg: context + msgBadDesc})
+}
+
+// errType panics with an *UnmarshalTypeError for the value with descriptor bd 
+// (described by value, or its ValueType if empty), which cannot be decoded into rt.
+// It is a *SyntaxError if bd is not a valid descriptor.
+func (d *Decoder) errType(bd byte, value string, rt reflect.Type) {
+	vt := getValueType(bd)
+	if vt == ValueInvalid {
+		d.errSyntax(bd, "")
+	}
+	if value == "" {
+		value = vt.String()
+	}
+	panic(&UnmarshalTypeError{Value: value, Type: rt, Offset: d.bdpos, Desc: bd})
+}
+
 // Unmarshal is a convenience function which decodes a stream of bytes into v.
-// It delegates to Decoder.Decode.
-func Unmarshal(data []byte, v interface{}, dam DecoderContainerResolver) error {
-	return NewDecoder(bytes.NewBuffer(data), dam).Decode(v)
+// It delegates to Decoder.Decode, on a Decoder reading from data (see NewDecoderBytes).
+// 
+// Lengths in the stream are checked against the length of data, so malicious 
+// or corrupt input cannot cause large allocations (see DecoderOptions).
+func Unmarshal(data []byte, v interface{}, dam DecoderContainerResolver) (err error) {
+	d := decPool.Get().(*Decoder)
+	if d.dam = dam; dam == nil {
+		d.dam = &DefaultDecoderContainerResolver
+	}
+	d.opts = DefaultDecoderOptions
+	d.ResetBytes(data)
+	err = d.Decode(v)
+	d.ResetBytes(nil)
+	decPool.Put(d)
+	return
+}
+
+// decPool holds Decoders for reuse by Unmarshal.
+var decPool = sync.Pool{
+	New: func() interface{} {
+		return NewDecoderBytes(nil, nil)
+	},
 }
@@ -34,19 +34,39 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 MsgPack library for Go.
 
 Implements:
-  http://wiki.msgpack.org/display/MSGPACK/Format+specification
+  https://github.com/msgpack/msgpack/blob/master/spec.md
 
 It provides features similar to encoding packages in the standard library (ie json, xml, gob, etc).
 
 Supports:
   - Standard Marshal/Unmarshal interface.
-  - Standard field renaming via tags
+  - Standard field renaming via tags (including integer keys, e.g. `msgpack:"1"`)
+  - Compact encoding of structs as arrays of their fields (the "toarray" option)
+  - Canonical encoding (sorted map keys, smallest encodings), for hashing and signing
   - Encoding from any value (struct, slice, map, primitives, pointers, interface{}, etc)
   - Decoding into pointer to any non-nil value (struct, slice, map, int, float32, bool, string, etc)
   - Decoding into a nil interface{} 
-  - Handles time.Time transparently 
+  - Strict decoding of structs (DisallowUnknownFields, and the "required" tag option)
+  - The str (str8/16/32) and bin (bin8/16/32) families of the current spec
+  - Extension types, via a registry of Go types (see RegisterExt) or RawExt
+  - Custom encoding for types implementing Marshaler and Unmarshaler
+    (falling back to encoding.BinaryMarshaler and encoding.TextMarshaler)
+  - RawMessage, for delaying decoding of a value or embedding an encoded value
+  - Limits on lengths, nesting depth and bytes read, for decoding untrusted input
+  - Decode errors with the offset in the stream and the path to the failing value
+    (see DecodeError, SyntaxError, UnmarshalTypeError)
+  - Low-level token API (Encoder.WriteXXX, Decoder.ReadXXX, Decoder.PeekType, Decoder.Skip)
+    for writing and reading messages without reflection
+  - Buffered encoding (NewBufferedEncoder), so each value is a single write to the stream
+  - Encoding into reusable buffers (MarshalAppend, NewEncoderBytes)
+  - Decoding directly from a []byte (NewDecoderBytes), optionally aliasing []byte values into it
+  - Reusable Encoders and Decoders (Reset), pooled by Marshal and Unmarshal
+  - Handles time.Time transparently (optionally as the spec's timestamp extension)
   - Provides a Server and Client Codec so msgpack can be used as communication protocol for net/rpc.
     Also includes an option for msgpack-rpc: http://wiki.msgpack.org/display/MSGPACK/RPC+specification
+    including notifications (see CustomRPCCodec)
+  - A standalone msgpack-rpc Server (NewServer), which calls Go functions of any signature
+    with the positional params of each request
 
 Usage
 
@@ -56,6 +76,11 @@ Usage
   enc = msgpack.NewEncoder(w)
   err = enc.Encode(v) 
   
+  //write the legacy raw format (no str8/bin) for older peers
+  opts := msgpack.DefaultEncoderOptions
+  opts.LegacyRaw = true
+  enc = msgpack.NewEncoderWithOptions(w, &opts)
+  
   //methods below are convenience methods over functions above.
   data, err = msgpack.Marshal(v) 
   err = msgpack.Unmarshal(data, &v, nil)
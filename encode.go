@@ -44,8 +44,12 @@ package msgpack
 import (
 	"io"
 	"bytes"
+	"sync"
+	"sync/atomic"
+	"encoding"
 	"reflect"
 	"math"
+	"sort"
 	"time"
 	"encoding/binary"
 )
@@ -55,33 +59,176 @@ var (
 	msgTagEnc = "msgpack.encoder"
 ) 
 
+// Default EncoderOptions used by NewEncoder() and when a nil parameter is passed 
+// to NewEncoderWithOptions().
+// Sample Usage:
+//   opts := msgpack.DefaultEncoderOptions // makes a copy
+//   opts.LegacyRaw = true // change some options
+//   err := msgpack.NewEncoderWithOptions(w, &opts).Encode(v)
+var DefaultEncoderOptions = EncoderOptions {
+	LegacyRaw: false,
+	TimeExt: false,
+	BinaryMarshaler: true,
+	TextMarshaler: true,
+}
+
+// EncoderOptions configures how an Encoder writes values to the stream.
+type EncoderOptions struct {
+	// LegacyRaw writes strings and []byte using the raw family of the original
+	// msgpack format (fixraw, raw16, raw32), for peers which do not understand 
+	// the str8 and bin types of the current spec (spec 2.0).
+	// The Decoder accepts both formats regardless of this setting.
+	LegacyRaw bool
+	// TimeExt writes time.Time as the timestamp extension (type -1) of the spec,
+	// which other msgpack libraries understand, rather than the 2-element array
+	// [seconds since epoch, nanoseconds offset].
+	// The Decoder accepts both formats regardless of this setting.
+	// This will become the default in a future release.
+	TimeExt bool
+	// BinaryMarshaler encodes values implementing encoding.BinaryMarshaler 
+	// (and not Marshaler) as bin, by calling MarshalBinary.
+	BinaryMarshaler bool
+	// TextMarshaler encodes values implementing encoding.TextMarshaler 
+	// (and not Marshaler or encoding.BinaryMarshaler) as str, by calling MarshalText.
+	TextMarshaler bool
+	// StructToArray encodes all structs as arrays of their fields in order, 
+	// as the toarray option does for a single struct type (see Encoder.Encode).
+	StructToArray bool
+	// Canonical encodes equal values to the same bytes, e.g. for hashing, signing 
+	// or caching by content:
+	//   - map entries are sorted by the encoded bytes of their keys
+	//   - non-negative integers use the smallest (unsigned) encoding, whatever their Go type
+	//   - NaN is always written as the same NaN, and -0 as 0 (floats otherwise keep their width)
+	// Lengths always use the smallest encoding. Values written by Marshaler 
+	// (and RawMessage, RawExt) are written as is.
+	Canonical bool
+}
+
+// A buffered Encoder writes its buffer out when it grows to encFlushSize, 
+// even in the middle of a value (unless it holds whole values).
+const encFlushSize = 32 * 1024
+
 // An Encoder writes an object to an output stream in the msgpack format.
 type Encoder struct {
 	w io.Writer
+	opts EncoderOptions
+	buffered bool
+	holdValues bool   // a buffered Encoder does not flush in the middle of a value (see rpcCodec)
+	nflush int        // number of flushes, so encodeBuffered can tell if a value was partly written
+	buf []byte        // output not yet written to w by a buffered Encoder (or all output, if w is nil)
+	fieldIdxs []int   // scratch buffer for encoding structs with omitempty fields
+	keyEnc *Encoder   // encodes map keys to be sorted, if Canonical (see encodeMapCanonical)
 	x [16]byte        //temp byte array re-used internally for efficiency
 	t1, t2, t3, t31, t5, t51, t9, t91 []byte // use these, so no need to constantly re-slice
 }
 
-// NewDecoder returns an Encoder for encoding an object.
+// NewEncoder returns an Encoder for encoding an object.
+// It uses DefaultEncoderOptions.
 func NewEncoder(w io.Writer) (e *Encoder) {	
-	e = &Encoder{w:w}
+	return NewEncoderWithOptions(w, nil)
+}
+
+// NewEncoderWithOptions returns an Encoder configured by the given options.
+// If nil EncoderOptions is passed, we use DefaultEncoderOptions.
+func NewEncoderWithOptions(w io.Writer, opts *EncoderOptions) (e *Encoder) {	
+	if opts == nil {
+		opts = &DefaultEncoderOptions
+	}
+	e = &Encoder{w:w, opts:*opts}
 	e.t1, e.t2, e.t3, e.t31, e.t5, e.t51, e.t9, e.t91 = 
 		e.x[:1], e.x[:2], e.x[:3], e.x[1:3], e.x[:5], e.x[1:5], e.x[:9], e.x[1:9]
 	return
 }
 
+// NewBufferedEncoder returns an Encoder which buffers its output, so that 
+// encoding a value makes a single call to w.Write (for values smaller than 32KB), 
+// rather than one per token. Encode and EncodeValue flush the buffer when done; 
+// after the Write methods, call Flush. A value which fails to encode is 
+// removed from the buffer, but a larger one may have been partly written.
+// If nil EncoderOptions is passed, we use DefaultEncoderOptions.
+func NewBufferedEncoder(w io.Writer, opts *EncoderOptions) (e *Encoder) {
+	e = NewEncoderWithOptions(w, opts)
+	e.buffered = true
+	return
+}
+
+// NewEncoderBytes returns an Encoder which appends its output to b, 
+// instead of writing to an io.Writer. Bytes returns the output.
+// If nil EncoderOptions is passed, we use DefaultEncoderOptions.
+// 
+// To reuse the Encoder and its buffer for another message, call ResetBytes(e.Bytes()[:0]).
+func NewEncoderBytes(b []byte, opts *EncoderOptions) (e *Encoder) {
+	e = NewEncoderWithOptions(nil, opts)
+	e.ResetBytes(b)
+	return
+}
+
+// Reset makes e write to w, discarding any buffered output, so an Encoder 
+// (and its internal state) can be reused for another stream, e.g. from a sync.Pool.
+// It keeps its options, and remains buffered if it was (which an Encoder 
+// from NewEncoderBytes is).
+func (e *Encoder) Reset(w io.Writer) {
+	if e.w == nil {
+		e.buf = nil // it is the caller's buffer (see NewEncoderBytes)
+	}
+	e.w, e.buf = w, e.buf[:0]
+}
+
+// ResetBytes makes e append its output to b (see NewEncoderBytes).
+func (e *Encoder) ResetBytes(b []byte) {
+	e.w, e.buffered, e.buf = nil, true, b
+}
+
+// Bytes returns the output of an Encoder from NewEncoderBytes: b with the 
+// encoded values appended. It is only valid until the next call to e.
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+// Flush writes any buffered output to the underlying writer.
+// It is a no-op for an Encoder which is not buffered (or from NewEncoderBytes).
+func (e *Encoder) Flush() (err error) {
+	defer panicToErr(&err) 
+	if len(e.buf) > 0 && e.w != nil {
+		e.flush()
+	}
+	return
+}
+
 // Encode writes an object into a stream in the MsgPack format.
 // 
+// Strings are encoded using the str family (fixstr, str8, str16, str32),
+// and []byte (or [N]byte) using the bin family (bin8, bin16, bin32).
+// If EncoderOptions.LegacyRaw is set, both are encoded as raw 
+// (fixraw, raw16, raw32) as defined by the original msgpack format.
+// 
 // time.Time is handled transparently, by (en)decoding (to)from a 
-// []int64{Seconds since Epoch, Nanoseconds offset}.
+// []int64{Seconds since Epoch, Nanoseconds offset}, or the timestamp 
+// extension if EncoderOptions.TimeExt is set.
 // 
 // Struct values encode as maps. Each exported struct field is encoded unless:
 //    - the field's tag is "-", or
 //    - the field is empty and its tag specifies the "omitempty" option.
 //
+// A key name which is an integer in canonical decimal form (e.g. `msgpack:"1"`, 
+// but not "01" or "+1") is encoded as an integer, not a str. Like protobuf 
+// field numbers, this is compact, and lets fields be renamed.
+// 
+// If the _struct field's tag specifies the "toarray" option (or EncoderOptions.StructToArray 
+// is set), the struct is encoded as an array of all its fields in order, without keys. 
+// This is much more compact, but fields can then only be added at the end.
+//
 // The empty values are false, 0, any nil pointer or interface value, 
 // and any array, slice, map, or string of length zero. 
 // 
+// Values of a type registered via RegisterExt are encoded as an extension,
+// and RawExt values are written as is.
+// 
+// Values implementing Marshaler (with a value or pointer receiver) are 
+// encoded by calling MarshalMsgpack. Else, values implementing 
+// encoding.BinaryMarshaler or encoding.TextMarshaler are encoded as bin or str
+// respectively, if enabled in EncoderOptions (as they are by default).
+// 
 // Anonymous fields are encoded inline if no msgpack tag is present.
 // Else they are encoded as regular fields.
 // 
@@ -96,7 +243,7 @@ func NewEncoder(w io.Writer) (e *Encoder) {
 // Examples:
 //    
 //      type MyStruct struct {
-//          _struct bool    `msgpack:",omitempty"`   //set omitempty for every field
+//          _struct bool    `msgpack:",omitempty"`   //set omitempty for every field (or toarray)
 //          Field1 string   `msgpack:"-"`            //skip this field
 //          Field2 int      `msgpack:"myName"`       //Use key "myName" in encode stream
 //          Field3 int32    `msgpack:",omitempty"`   //use key "Field3". Omit if empty.
@@ -110,11 +257,124 @@ func (e *Encoder) Encode(v interface{}) (err error) {
 
 // EncodeValue encodes a reflect.Value.
 func (e *Encoder) EncodeValue(rv reflect.Value) (err error) {
+	if err = e.encodeBuffered(rv); err == nil {
+		err = e.Flush()
+	}
+	return
+}
+
+// encodeBuffered encodes rv without flushing a buffered Encoder. 
+// On error, the partial output of rv is removed from the buffer, keeping 
+// any earlier buffered output. But if rv is larger than encFlushSize, part of it 
+// may have been written already (unless e.holdValues is set), which 
+// leaves a broken value in the stream.
+func (e *Encoder) encodeBuffered(rv reflect.Value) (err error) {
+	if e.buffered {
+		mark, nflush := len(e.buf), e.nflush
+		defer func() {
+			if err != nil && e.nflush == nflush {
+				e.buf = e.buf[:mark]
+			} else if err != nil {
+				e.buf = e.buf[:0]
+			}
+		}()
+	}
 	defer panicToErr(&err) 
 	e.encodeValue(rv)
 	return
 }
 
+// The Write methods below write a single token (a primitive value or a container header)
+// to the stream, without reflection. They can be mixed freely with Encode,
+// e.g. to stream a huge array by writing its header and then encoding each element:
+// 
+//   err = enc.WriteArrayHeader(n)
+//   for rows.Next() {
+//       err = enc.Encode(row)
+//   }
+
+// WriteArrayHeader writes the header of an array of n elements.
+// The n elements must be written next.
+func (e *Encoder) WriteArrayHeader(n int) (err error) {
+	defer panicToErr(&err)
+	e.writeContainerLen(ContainerList, n)
+	return
+}
+
+// WriteMapHeader writes the header of a map of n entries.
+// The n keys and values must be written next (key1, value1, key2, value2, ...).
+func (e *Encoder) WriteMapHeader(n int) (err error) {
+	defer panicToErr(&err)
+	e.writeContainerLen(ContainerMap, n)
+	return
+}
+
+// WriteInt writes a signed integer using the smallest encoding.
+func (e *Encoder) WriteInt(i int64) (err error) {
+	defer panicToErr(&err)
+	e.encInt(i)
+	return
+}
+
+// WriteUint writes an unsigned integer using the smallest encoding.
+func (e *Encoder) WriteUint(i uint64) (err error) {
+	defer panicToErr(&err)
+	e.encUint(i)
+	return
+}
+
+// WriteFloat32 writes a float32.
+func (e *Encoder) WriteFloat32(f float32) (err error) {
+	defer panicToErr(&err)
+	e.encFloat32(f)
+	return
+}
+
+// WriteFloat64 writes a float64.
+func (e *Encoder) WriteFloat64(f float64) (err error) {
+	defer panicToErr(&err)
+	e.encFloat64(f)
+	return
+}
+
+// WriteString writes a str.
+func (e *Encoder) WriteString(s string) (err error) {
+	defer panicToErr(&err)
+	e.encString(s)
+	return
+}
+
+// WriteBytes writes a bin (or a raw if EncoderOptions.LegacyRaw is set).
+func (e *Encoder) WriteBytes(bs []byte) (err error) {
+	defer panicToErr(&err)
+	e.writeContainerLen(ContainerBinary, len(bs))
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+	return
+}
+
+// WriteNil writes nil.
+func (e *Encoder) WriteNil() (err error) {
+	defer panicToErr(&err)
+	e.encNil()
+	return
+}
+
+// WriteBool writes a bool.
+func (e *Encoder) WriteBool(b bool) (err error) {
+	defer panicToErr(&err)
+	e.encBool(b)
+	return
+}
+
+// WriteExt writes an extension with the given type code and data.
+func (e *Encoder) WriteExt(xtag int8, data []byte) (err error) {
+	defer panicToErr(&err)
+	e.writeExt(xtag, data)
+	return
+}
+
 func (e *Encoder) encode(v interface{}) {
 	e.encodeValue(reflectValue(v))
 }
@@ -125,119 +385,386 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 	//	log("++  exit encode rv: %v, %v", rv, rv.Interface())
 	//}()
 	
-	// Tested with a type assertion for all common types first, but this increased encoding time
-	// sometimes by up to 20% (weird). So just use the reflect.Kind switch alone.
-	
-	// ensure more common cases appear early in switch.
-	switch rk := rv.Kind(); rk {
+	if !rv.IsValid() {
+		e.encNil()
+		return
+	}
+	getEncFn(rv.Type())(e, rv)
+}
+
+// encFn encodes a value of the type it was built for (see getEncFn).
+type encFn func(e *Encoder, rv reflect.Value)
+
+// encFns caches the encFn of each reflect.Type. It is cleared by RegisterExt.
+var encFns sync.Map
+
+// getEncFn returns the encFn for rt, building it on first use. So the checks 
+// for extensions and marshalers, the reflect.Kind switch, and the struct field lookup
+// happen once per type, not for every value.
+func getEncFn(rt reflect.Type) encFn {
+	if fn, ok := encFns.Load(rt); ok {
+		return fn.(encFn)
+	}
+	version := atomic.LoadUint64(&fnsVersion)
+	// For recursive types (e.g. type T []T), first store a func which waits for 
+	// the real one to be built.
+	var wg sync.WaitGroup
+	var fn encFn
+	wg.Add(1)
+	fi, loaded := encFns.LoadOrStore(rt, encFn(func(e *Encoder, rv reflect.Value) {
+		wg.Wait()
+		fn(e, rv)
+	}))
+	if loaded {
+		return fi.(encFn)
+	}
+	fn = buildEncFnOrErr(rt)
+	wg.Done()
+	storeFn(&encFns, rt, fn, version)
+	return fn
+}
+
+// buildEncFnOrErr is buildEncFn, but if building panics (e.g. on an unsupported 
+// type), it returns an encFn which panics the same way when called. So every 
+// encode of rt fails alike, and the func stored first by getEncFn is released.
+func buildEncFnOrErr(rt reflect.Type) (fn encFn) {
+	defer func() {
+		if x := recover(); x != nil {
+			fn = func(e *Encoder, rv reflect.Value) {
+				panic(x)
+			}
+		}
+	}()
+	return buildEncFn(rt)
+}
+
+func buildEncFn(rt reflect.Type) encFn {
+	if rt == rawExtTyp {
+		return (*Encoder).encodeRawExt
+	}
+	if xi := getExtForType(rt); xi != nil {
+		return func(e *Encoder, rv reflect.Value) {
+			e.encodeExt(xi, rv)
+		}
+	}
+	fn := buildEncKindFn(rt)
+	if rk := rt.Kind(); rk == reflect.Ptr || rk == reflect.Interface {
+		// pointers and interfaces are checked (after nil check) when we get to their elem
+		return fn
+	}
+	if mfn := encMarshalerFn(rt, marshalerTyp, (*Encoder).encodeMarshaler); mfn != nil {
+		return mfn
+	}
+	// time.Time has its own handling, though it implements both below.
+	if rt == timeTyp {
+		return fn
+	}
+	bfn := encMarshalerFn(rt, binaryMarshalerTyp, (*Encoder).encodeBinaryMarshaler)
+	tfn := encMarshalerFn(rt, textMarshalerTyp, (*Encoder).encodeTextMarshaler)
+	if bfn == nil && tfn == nil {
+		return fn
+	}
+	return func(e *Encoder, rv reflect.Value) {
+		if bfn != nil && e.opts.BinaryMarshaler {
+			bfn(e, rv)
+		} else if tfn != nil && e.opts.TextMarshaler {
+			tfn(e, rv)
+		} else {
+			fn(e, rv)
+		}
+	}
+}
+
+// encMarshalerFn returns an encFn which calls mfn with the value, or its address, 
+// if rt (or *rt) implements the interface type it. Else it returns nil.
+// If only *rt implements it and the value is not addressable, the address of a copy is used.
+func encMarshalerFn(rt, it reflect.Type, mfn func(*Encoder, reflect.Value)) encFn {
+	if rt.Implements(it) {
+		return mfn
+	}
+	if !reflect.PtrTo(rt).Implements(it) {
+		return nil
+	}
+	return func(e *Encoder, rv reflect.Value) {
+		if !rv.CanAddr() {
+			rv2 := reflect.New(rt).Elem()
+			rv2.Set(rv)
+			rv = rv2
+		}
+		mfn(e, rv.Addr())
+	}
+}
+
+func buildEncKindFn(rt reflect.Type) encFn {
+	switch rk := rt.Kind(); rk {
 	case reflect.Bool:
-		e.encBool(rv.Bool())
+		return func(e *Encoder, rv reflect.Value) {
+			e.encBool(rv.Bool())
+		}
 	case reflect.String:
-		e.encString(rv.String())
+		return func(e *Encoder, rv reflect.Value) {
+			e.encString(rv.String())
+		}
 	case reflect.Int, reflect.Int8, reflect.Int64, reflect.Int32, reflect.Int16:
-		e.encInt(rv.Int())
+		return func(e *Encoder, rv reflect.Value) {
+			e.encInt(rv.Int())
+		}
 	case reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16:
-		e.encUint(rv.Uint())
+		return func(e *Encoder, rv reflect.Value) {
+			e.encUint(rv.Uint())
+		}
 	case reflect.Float64:
-		e.t9[0] = 0xcb
-		binary.BigEndian.PutUint64(e.t91, math.Float64bits(rv.Float()))
-		e.writeb(9, e.t9)
+		return func(e *Encoder, rv reflect.Value) {
+			e.encFloat64(rv.Float())
+		}
 	case reflect.Float32:
-		e.t5[0] = 0xca
-		binary.BigEndian.PutUint32(e.t51, math.Float32bits(float32(rv.Float())))
-		e.writeb(5, e.t5)
-	case reflect.Slice:
-		if rv.IsNil() {
-			e.encNil()
-			break
-		} 
-		l := rv.Len()
-		if rv.Type() == byteSliceTyp {
-			e.writeContainerLen(ContainerRawBytes, l)
-			if l > 0 {
-				e.writeb(l, rv.Bytes())
-			}
-			break
+		return func(e *Encoder, rv reflect.Value) {
+			e.encFloat32(float32(rv.Float()))
 		}
-		e.writeContainerLen(ContainerList, l)
-		for j := 0; j < l; j++ {
-			e.encode(rv.Index(j))
+	case reflect.Slice:
+		if rt == byteSliceTyp {
+			return (*Encoder).encodeByteSlice
 		}
-	case reflect.Array:
-		l := rv.Len()
-		// this should not happen (a 0-elem array makes no sense) ... but just in case
-		if l == 0 {
+		elemFn := getEncFn(rt.Elem())
+		return func(e *Encoder, rv reflect.Value) {
+			if rv.IsNil() {
+				e.encNil()
+				return
+			}
+			l := rv.Len()
 			e.writeContainerLen(ContainerList, l)
-			break
+			for j := 0; j < l; j++ {
+				elemFn(e, rv.Index(j))
+			}
 		}
-		// log("---- %v", rv.Type())
-		// if rv.Type().Elem().Kind == reflect.Uint8 { // surprisingly expensive (check 1st value instead)
-		if rv.Index(0).Kind() == reflect.Uint8 {
-			e.writeContainerLen(ContainerRawBytes, l)
-			e.writeb(l, rv.Slice(0, l).Bytes())
-			break
+	case reflect.Array:
+		l := rt.Len()
+		if l > 0 && rt.Elem().Kind() == reflect.Uint8 {
+			return (*Encoder).encodeByteArray
 		}
-		e.writeContainerLen(ContainerList, l)
-		for j := 0; j < l; j++ {
-			e.encode(rv.Index(j))
+		// (a 0-elem array makes no sense) ... but just in case
+		elemFn := getEncFn(rt.Elem())
+		return func(e *Encoder, rv reflect.Value) {
+			e.writeContainerLen(ContainerList, l)
+			for j := 0; j < l; j++ {
+				elemFn(e, rv.Index(j))
+			}
 		}
 	case reflect.Map:
-		if rv.IsNil() {
-			e.encNil()
-			break
-		}
-		e.writeContainerLen(ContainerMap, rv.Len())
-		for _, mk := range rv.MapKeys() {
-			e.encode(mk)
-			e.encode(rv.MapIndex(mk))
+		keyFn, valFn := getEncFn(rt.Key()), getEncFn(rt.Elem())
+		return func(e *Encoder, rv reflect.Value) {
+			if rv.IsNil() {
+				e.encNil()
+				return
+			}
+			if e.opts.Canonical {
+				e.encodeMapCanonical(rv, keyFn, valFn)
+				return
+			}
+			e.writeContainerLen(ContainerMap, rv.Len())
+			for _, mk := range rv.MapKeys() {
+				keyFn(e, mk)
+				valFn(e, rv.MapIndex(mk))
+			}
 		}
 	case reflect.Struct:
-		rt := rv.Type()
 		//treat time.Time specially
 		if rt == timeTyp {
-			tt := rv.Interface().(time.Time)
-			e.encode([2]int64{tt.Unix(), int64(tt.Nanosecond())})
-			break
+			return (*Encoder).encodeTime
 		}
-		e.encodeStruct(rt, rv)
-	case reflect.Ptr, reflect.Interface:
-		if rv.IsNil() {
-			e.encNil()
-			break
+		sis := getStructFieldInfos(rt)
+		fns := make([]encFn, len(sis.sis))
+		for j, si := range sis.sis {
+			fns[j] = getEncFn(si.fieldType(rt))
+		}
+		return func(e *Encoder, rv reflect.Value) {
+			e.encodeStruct(rv, sis, fns)
+		}
+	case reflect.Ptr:
+		elemFn := getEncFn(rt.Elem())
+		return func(e *Encoder, rv reflect.Value) {
+			if rv.IsNil() {
+				e.encNil()
+				return
+			}
+			elemFn(e, rv.Elem())
+		}
+	case reflect.Interface:
+		return func(e *Encoder, rv reflect.Value) {
+			if rv.IsNil() {
+				e.encNil()
+				return
+			}
+			e.encodeValue(rv.Elem())
 		}
-		e.encodeValue(rv.Elem())
-	case reflect.Invalid:
-		e.encNil()
 	default:
-		e.err("Unsupported kind: %s, for: %#v", rk, rv)
+		return func(e *Encoder, rv reflect.Value) {
+			e.err("Unsupported kind: %s, for: %#v", rk, rv)
+		}
+	}
+}
+
+func (e *Encoder) encodeRawExt(rv reflect.Value) {
+	rx := rv.Interface().(RawExt)
+	e.writeExt(rx.Type, rx.Data)
+}
+
+func (e *Encoder) encodeByteSlice(rv reflect.Value) {
+	if rv.IsNil() {
+		e.encNil()
+		return
+	} 
+	l := rv.Len()
+	e.writeContainerLen(ContainerBinary, l)
+	if l > 0 {
+		e.writeb(l, rv.Bytes())
+	}
+}
+
+func (e *Encoder) encodeByteArray(rv reflect.Value) {
+	l := rv.Len()
+	e.writeContainerLen(ContainerBinary, l)
+	if rv.CanAddr() {
+		e.writeb(l, rv.Slice(0, l).Bytes())
+	} else {
+		// cannot slice an unaddressable array, so copy it out
+		bs := make([]byte, l)
+		reflect.Copy(reflect.ValueOf(bs), rv)
+		e.writeb(l, bs)
+	}
+}
+
+func (e *Encoder) encodeTime(rv reflect.Value) {
+	tt := rv.Interface().(time.Time)
+	if e.opts.TimeExt {
+		e.writeExt(timeExtTag, encodeTimeExt(tt))
+	} else {
+		e.encode([2]int64{tt.Unix(), int64(tt.Nanosecond())})
 	}
-	return
 }
 
 func (e *Encoder) writeContainerLen(ct ContainerType, l int) {
-	locutoff, b0, b1, b2 := getContainerByteDesc(ct)
+	legacy := e.opts.LegacyRaw && (ct == ContainerRawBytes || ct == ContainerBinary)
+	if legacy {
+		ct = ContainerRawBytes
+	}
+	locutoff, b0, b8, b16, b32 := getContainerByteDesc(ct)
+	if legacy {
+		b8 = 0 // raw has no 8-bit length form
+	}
 
 	switch {
 	case l < locutoff:
 		e.t1[0] = (b0 | byte(l))
 		e.writeb(1, e.t1)
+	case b8 != 0 && l < 256:
+		e.t2[0], e.t2[1] = b8, byte(l)
+		e.writeb(2, e.t2)
 	case l < 65536:
-		e.t3[0] = b1
+		e.t3[0] = b16
 		binary.BigEndian.PutUint16(e.t31, uint16(l))
 		e.writeb(3, e.t3)
 	default:
-		e.t5[0] = b2
+		e.t5[0] = b32
 		binary.BigEndian.PutUint32(e.t51, uint32(l))
 		e.writeb(5, e.t5)
 	}
 }
 
+func (e *Encoder) encodeMarshaler(rv reflect.Value) {
+	bs, err := rv.Interface().(Marshaler).MarshalMsgpack()
+	if err != nil {
+		e.err("Error calling MarshalMsgpack for type: %v: %v", rv.Type(), err)
+	}
+	if len(bs) == 0 {
+		e.err("MarshalMsgpack for type: %v returned no bytes", rv.Type())
+	}
+	e.writeb(len(bs), bs)
+}
+
+func (e *Encoder) encodeBinaryMarshaler(rv reflect.Value) {
+	bs, err := rv.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		e.err("Error calling MarshalBinary for type: %v: %v", rv.Type(), err)
+	}
+	e.writeContainerLen(ContainerBinary, len(bs))
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+}
+
+func (e *Encoder) encodeTextMarshaler(rv reflect.Value) {
+	bs, err := rv.Interface().(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		e.err("Error calling MarshalText for type: %v: %v", rv.Type(), err)
+	}
+	e.writeContainerLen(ContainerRawBytes, len(bs))
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+}
+
+func (e *Encoder) encodeExt(xi *extInfo, rv reflect.Value) {
+	bs, err := xi.encFn(rv)
+	if err != nil {
+		e.err("Error encoding extension: %v: %v", xi.rt, err)
+	}
+	e.writeExt(xi.tag, bs)
+}
+
+// writeExt writes an extension, using fixext if the data length allows.
+func (e *Encoder) writeExt(xtag int8, bs []byte) {
+	l := len(bs)
+	var n int
+	switch l {
+	case 1, 2, 4, 8, 16:
+		switch l {
+		case 1:
+			e.x[0] = 0xd4
+		case 2:
+			e.x[0] = 0xd5
+		case 4:
+			e.x[0] = 0xd6
+		case 8:
+			e.x[0] = 0xd7
+		case 16:
+			e.x[0] = 0xd8
+		}
+		e.x[1] = byte(xtag)
+		n = 2
+	default:
+		switch {
+		case l < 256:
+			e.x[0], e.x[1], e.x[2] = 0xc7, byte(l), byte(xtag)
+			n = 3
+		case l < 65536:
+			e.x[0] = 0xc8
+			binary.BigEndian.PutUint16(e.x[1:3], uint16(l))
+			e.x[3] = byte(xtag)
+			n = 4
+		default:
+			e.x[0] = 0xc9
+			binary.BigEndian.PutUint32(e.x[1:5], uint32(l))
+			e.x[5] = byte(xtag)
+			n = 6
+		}
+	}
+	e.writeb(n, e.x[:n])
+	if l > 0 {
+		e.writeb(l, bs)
+	}
+}
+
 func (e *Encoder) encNil() {
 	e.t1[0] = 0xc0
 	e.writeb(1, e.t1)
 }
 
 func (e *Encoder) encInt(i int64) {
+	if e.opts.Canonical && i >= 0 {
+		e.encUint(uint64(i))
+		return
+	}
 	switch {
 	case i < math.MinInt32 || i > math.MaxInt32:
 		e.t9[0] = 0xd3
@@ -285,6 +812,30 @@ func (e *Encoder) encUint(i uint64) {
 	}
 }
 
+func (e *Encoder) encFloat32(f float32) {
+	bits := math.Float32bits(f)
+	if e.opts.Canonical && f != f {
+		bits = 0x7fc00000 // NaN
+	} else if e.opts.Canonical && f == 0 {
+		bits = 0 // not -0
+	}
+	e.t5[0] = 0xca
+	binary.BigEndian.PutUint32(e.t51, bits)
+	e.writeb(5, e.t5)
+}
+
+func (e *Encoder) encFloat64(f float64) {
+	bits := math.Float64bits(f)
+	if e.opts.Canonical && f != f {
+		bits = 0x7ff8000000000000 // NaN
+	} else if e.opts.Canonical && f == 0 {
+		bits = 0 // not -0
+	}
+	e.t9[0] = 0xcb
+	binary.BigEndian.PutUint64(e.t91, bits)
+	e.writeb(9, e.t9)
+}
+
 func (e *Encoder) encBool(b bool) {
 	if b {
 		e.t1[0] = 0xc3
@@ -294,39 +845,107 @@ func (e *Encoder) encBool(b bool) {
 	e.writeb(1, e.t1)
 }
 
-func (e *Encoder) encodeStruct(rt reflect.Type, rv reflect.Value) {
-	sis := getStructFieldInfos(rt)
-	// e.writeContainerLen(ContainerMap, len(sis.sis))
-	// for _, si := range sis.sis {
-	// 	e.encode(si.encNameBs)
-	// 	e.encode(si.field(rv))
-	// }
-	// return
+// encodeMapCanonical writes the map entries sorted by the encoded bytes of their keys.
+// The keys are encoded into the buffer of e.keyEnc, after those of any map being 
+// encoded around this one (whose keys are in use till it is done).
+func (e *Encoder) encodeMapCanonical(rv reflect.Value, keyFn, valFn encFn) {
+	mks := rv.MapKeys()
+	if e.keyEnc == nil {
+		e.keyEnc = NewEncoderBytes(nil, &e.opts)
+	}
+	ke := e.keyEnc
+	ke.opts = e.opts // they may have changed (see MarshalAppend)
+	mark := len(ke.buf)
+	defer func() { ke.buf = ke.buf[:mark] }()
+	ends := make([]int, len(mks))
+	for j, mk := range mks {
+		keyFn(ke, mk)
+		ends[j] = len(ke.buf) - mark
+	}
+	kbs := ke.buf[mark:]
+	sorted := canonicalMapKeys{make([][]byte, len(mks)), mks}
+	for j, start := 0, 0; j < len(mks); j++ {
+		sorted.bs[j], start = kbs[start:ends[j]], ends[j]
+	}
+	sort.Sort(sorted)
 	
-	encNames := make([][]byte, len(sis.sis))
-	rvals := make([]reflect.Value, len(sis.sis))
-	newlen := 0
-	for _, si := range sis.sis {
-		rval0 := si.field(rv)
-		if si.omitEmpty && isEmptyValue(rval0) {
-			continue
+	e.writeContainerLen(ContainerMap, len(mks))
+	for j, mk := range sorted.mks {
+		e.writeb(len(sorted.bs[j]), sorted.bs[j])
+		valFn(e, rv.MapIndex(mk))
+	}
+}
+
+// canonicalMapKeys sorts map keys by their encoded bytes.
+type canonicalMapKeys struct {
+	bs [][]byte
+	mks []reflect.Value
+}
+
+func (x canonicalMapKeys) Len() int { return len(x.bs) }
+func (x canonicalMapKeys) Less(i, j int) bool { return bytes.Compare(x.bs[i], x.bs[j]) < 0 }
+func (x canonicalMapKeys) Swap(i, j int) {
+	x.bs[i], x.bs[j] = x.bs[j], x.bs[i]
+	x.mks[i], x.mks[j] = x.mks[j], x.mks[i]
+}
+
+// encodeStruct encodes the struct rv. fns are the encFns of its fields (in sis).
+func (e *Encoder) encodeStruct(rv reflect.Value, sis *structFieldInfos, fns []encFn) {
+	if sis.toArray || e.opts.StructToArray {
+		e.writeContainerLen(ContainerList, len(sis.sis))
+		for j, si := range sis.sis {
+			fns[j](e, si.field(rv))
+		}
+		return
+	}
+	if sis.numOmitEmpty == 0 {
+		e.writeContainerLen(ContainerMap, len(sis.sis))
+		for k, si := range sis.sis {
+			e.encStructFieldKey(si)
+			fns[k](e, si.field(rv))
 		}
-		encNames[newlen] = si.encNameBs
-		rvals[newlen] = rval0
-		newlen++
+		return
 	}
 	
+	// Find the fields to encode, to write the map header first. Their indexes 
+	// are appended to e.fieldIdxs, a scratch buffer shared with nested structs 
+	// (which append after ours, and truncate back when done).
+	start := len(e.fieldIdxs)
+	for k, si := range sis.sis {
+		if si.omitEmpty && isEmptyValue(si.field(rv)) {
+			continue
+		}
+		e.fieldIdxs = append(e.fieldIdxs, k)
+	}
+	newlen := len(e.fieldIdxs) - start
 	e.writeContainerLen(ContainerMap, newlen)
 	for j := 0; j < newlen; j++ {
-		e.encode(encNames[j])
-		e.encode(rvals[j])
+		k := e.fieldIdxs[start + j]
+		si := sis.sis[k]
+		e.encStructFieldKey(si)
+		fns[k](e, si.field(rv))
+	}
+	e.fieldIdxs = e.fieldIdxs[:start]
+}
+
+func (e *Encoder) encStructFieldKey(si *structFieldInfo) {
+	if si.intKey {
+		e.encInt(si.encInt)
+	} else {
+		e.encStringBytes(si.encNameBs)
 	}
-	
 }
 
 func (e *Encoder) encString(s string) {
 	numbytes := len(s)
 	e.writeContainerLen(ContainerRawBytes, numbytes)
+	if e.buffered {
+		e.buf = append(e.buf, s...)
+		if len(e.buf) >= encFlushSize && e.w != nil && !e.holdValues {
+			e.flush()
+		}
+		return
+	}
 	// e.encode([]byte(s)) // using io.WriteString is faster
 	n, err := io.WriteString(e.w, s)
 	if err != nil {
@@ -337,8 +956,35 @@ func (e *Encoder) encString(s string) {
 	}
 }
 
+// encStringBytes writes bs as a str (e.g. struct field names, which are cached as []byte).
+func (e *Encoder) encStringBytes(bs []byte) {
+	e.writeContainerLen(ContainerRawBytes, len(bs))
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+}
+
 func (e *Encoder) writeb(numbytes int, bs []byte) {
 	// no sanity checking. Assume callers pass valid arguments. It's pkg-private: we can control it.
+	if e.buffered {
+		e.buf = append(e.buf, bs...)
+		if len(e.buf) >= encFlushSize && e.w != nil && !e.holdValues {
+			e.flush()
+		}
+		return
+	}
+	e.write(numbytes, bs)
+}
+
+// flush writes out (and empties) the buffer of a buffered Encoder.
+func (e *Encoder) flush() {
+	bs := e.buf
+	e.buf = e.buf[:0]
+	e.nflush++
+	e.write(len(bs), bs)
+}
+
+func (e *Encoder) write(numbytes int, bs []byte) {
 	n, err := e.w.Write(bs)
 	if err != nil {
 		// propagage io.EOF upwards (it's special, and must be returned AS IS)
@@ -360,11 +1006,31 @@ func (e *Encoder) err(format string, params ...interface{}) {
 // Marshal is a convenience function which encodes v to a stream of bytes. 
 // It delegates to Encoder.Encode.
 func Marshal(v interface{}) (b []byte, err error) {
-	bs := new(bytes.Buffer)
-	if err = NewEncoder(bs).Encode(v); err == nil {
-		b = bs.Bytes()
+	return MarshalAppend(nil, v)
+}
+
+// MarshalAppend encodes v like Marshal, appending to dst, and returns the 
+// extended buffer. On error, it returns dst. 
+// Passing a reused buffer (e.g. buf[:0]) avoids allocating for each message.
+func MarshalAppend(dst []byte, v interface{}) (b []byte, err error) {
+	e := encPool.Get().(*Encoder)
+	e.opts = DefaultEncoderOptions
+	e.ResetBytes(dst)
+	if err = e.Encode(v); err == nil {
+		b = e.Bytes()
+	} else {
+		b = dst
 	}
+	e.ResetBytes(nil)
+	encPool.Put(e)
 	return
 }
 
+// encPool holds Encoders for reuse by Marshal and MarshalAppend.
+var encPool = sync.Pool{
+	New: func() interface{} {
+		return NewEncoderBytes(nil, nil)
+	},
+}
+
 
@@ -0,0 +1,210 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+	"encoding/binary"
+)
+
+// timeExtTag is the type code of the timestamp extension defined by the spec.
+const timeExtTag int8 = -1
+
+// RawExt is an extension value (fixext1..16, ext8/16/32) as it appears in the stream.
+// 
+// Decoding an extension into a nil interface{} yields a RawExt if its type code 
+// has not been registered via RegisterExt. Encoding a RawExt writes it back as is.
+type RawExt struct {
+	Type int8
+	Data []byte
+}
+
+// ExtEncodeFn returns the data bytes of an extension for rv 
+// (a value of the registered type).
+type ExtEncodeFn func(rv reflect.Value) ([]byte, error)
+
+// ExtDecodeFn sets rv (a settable value of the registered type) 
+// from the data bytes of an extension.
+type ExtDecodeFn func(rv reflect.Value, data []byte) error
+
+type extInfo struct {
+	tag   int8
+	rt    reflect.Type
+	encFn ExtEncodeFn
+	decFn ExtDecodeFn
+}
+
+type extRegistry struct {
+	byType map[reflect.Type]*extInfo
+	byTag  map[int8]*extInfo
+}
+
+var (
+	msgTagExt = "msgpack.ext"
+	rawExtTyp = reflect.TypeOf(RawExt{})
+
+	// extRegistry is copy-on-write, so lookups (done for every value) need no lock.
+	// Writers hold extsMutex.
+	exts atomic.Value
+	extsMutex sync.Mutex
+)
+
+func init() {
+	exts.Store(&extRegistry{
+		byType: make(map[reflect.Type]*extInfo),
+		byTag: make(map[int8]*extInfo),
+	})
+}
+
+// RegisterExt registers an extension type code for values of the Go type rt.
+// 
+// Such values are encoded as an extension, whose data is got by calling encFn.
+// When decoding, decFn is called to set a value of type rt from the extension data.
+// An extension of this type code decoded into a nil interface{} yields a value of type rt.
+// 
+// Type codes 0 to 127 are for application use. Negative codes are reserved by the spec
+// (-1 is the timestamp extension, used for time.Time), and cannot be registered.
+// A type code or Go type can only be registered once (registering the same 
+// pair again just replaces the functions).
+func RegisterExt(xtag int8, rt reflect.Type, encFn ExtEncodeFn, decFn ExtDecodeFn) (err error) {
+	if rt == nil || encFn == nil || decFn == nil {
+		return fmt.Errorf("%s: RegisterExt: type, encode and decode functions must be non-nil", msgTagExt)
+	}
+	if rt == rawExtTyp || rt == timeTyp || rt.Kind() == reflect.Ptr || rt.Kind() == reflect.Interface {
+		return fmt.Errorf("%s: RegisterExt: Cannot register type: %v", msgTagExt, rt)
+	}
+	if xtag < 0 {
+		return fmt.Errorf("%s: RegisterExt: Type code %d is reserved by the spec", msgTagExt, xtag)
+	}
+	extsMutex.Lock()
+	defer extsMutex.Unlock()
+	
+	x0 := exts.Load().(*extRegistry)
+	if xi, ok := x0.byTag[xtag]; ok && xi.rt != rt {
+		return fmt.Errorf("%s: RegisterExt: Type code %d already registered for %v", msgTagExt, xtag, xi.rt)
+	}
+	if xi, ok := x0.byType[rt]; ok && xi.tag != xtag {
+		return fmt.Errorf("%s: RegisterExt: Type %v already registered with type code %d", msgTagExt, rt, xi.tag)
+	}
+	
+	x := &extRegistry{
+		byType: make(map[reflect.Type]*extInfo, len(x0.byType) + 1),
+		byTag: make(map[int8]*extInfo, len(x0.byTag) + 1),
+	}
+	for k, v := range x0.byType {
+		x.byType[k] = v
+	}
+	for k, v := range x0.byTag {
+		x.byTag[k] = v
+	}
+	xi := &extInfo{tag: xtag, rt: rt, encFn: encFn, decFn: decFn}
+	x.byType[rt] = xi
+	x.byTag[xtag] = xi
+	exts.Store(x)
+	// the encode/decode funcs built for each type check for extensions once, so rebuild them.
+	atomic.AddUint64(&fnsVersion, 1)
+	clearFns(&encFns)
+	clearFns(&decFns)
+	return
+}
+
+// fnsVersion is incremented by RegisterExt after it changes exts, and before it 
+// clears encFns and decFns. A fn built while it changed may have seen the old 
+// extensions, so storeFn does not keep it.
+var fnsVersion uint64
+
+func clearFns(fns *sync.Map) {
+	fns.Range(func(k, v interface{}) bool {
+		fns.Delete(k)
+		return true
+	})
+}
+
+// storeFn caches fn (an encFn or decFn) for rt in fns, unless RegisterExt was 
+// called since fnsVersion was version. Checking after the Store means a stale fn 
+// is either removed here, or by the clearFns which follows the increment.
+func storeFn(fns *sync.Map, rt reflect.Type, fn interface{}, version uint64) {
+	fns.Store(rt, fn)
+	if atomic.LoadUint64(&fnsVersion) != version {
+		fns.Delete(rt)
+	}
+}
+
+func getExtForType(rt reflect.Type) *extInfo {
+	return exts.Load().(*extRegistry).byType[rt]
+}
+
+func getExtForTag(xtag int8) *extInfo {
+	return exts.Load().(*extRegistry).byTag[xtag]
+}
+
+// encodeTimeExt returns the data of a timestamp extension, using the smallest
+// of the timestamp32, timestamp64 and timestamp96 formats which can hold t.
+func encodeTimeExt(t time.Time) (bs []byte) {
+	sec, nsec := t.Unix(), uint64(t.Nanosecond())
+	switch {
+	case sec >> 34 != 0:
+		bs = make([]byte, 12)
+		binary.BigEndian.PutUint32(bs, uint32(nsec))
+		binary.BigEndian.PutUint64(bs[4:], uint64(sec))
+	case nsec == 0 && sec >> 32 == 0:
+		bs = make([]byte, 4)
+		binary.BigEndian.PutUint32(bs, uint32(sec))
+	default:
+		bs = make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, nsec << 34 | uint64(sec))
+	}
+	return
+}
+
+// decodeTimeExt returns the time (in UTC) held in the data of a timestamp extension.
+func decodeTimeExt(bs []byte) (t time.Time, err error) {
+	switch len(bs) {
+	case 4:
+		t = time.Unix(int64(binary.BigEndian.Uint32(bs)), 0)
+	case 8:
+		x := binary.BigEndian.Uint64(bs)
+		t = time.Unix(int64(x & 0x3ffffffff), int64(x >> 34))
+	case 12:
+		t = time.Unix(int64(binary.BigEndian.Uint64(bs[4:])), int64(binary.BigEndian.Uint32(bs)))
+	default:
+		err = fmt.Errorf("%s: Invalid timestamp extension length: %d", msgTagExt, len(bs))
+		return
+	}
+	t = t.UTC()
+	return
+}
@@ -33,10 +33,14 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package msgpack
 
 import (
+	"encoding"
+	"errors"
 	"unicode"
 	"unicode/utf8"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"strconv"
 	"strings"
 	"fmt"
 	"time"
@@ -45,22 +49,83 @@ import (
 type ContainerType byte
 
 const (
+	// ContainerRawBytes is the str family (fixstr, str8, str16, str32),
+	// which was called raw in the original msgpack format.
 	ContainerRawBytes = ContainerType('b')
+	// ContainerBinary is the bin family (bin8, bin16, bin32) of the current spec.
+	ContainerBinary = ContainerType('y')
 	ContainerList = ContainerType('a')
 	ContainerMap = ContainerType('m')
 )
 
+// Marshaler is implemented by types which can encode themselves into msgpack.
+// MarshalMsgpack must return a single, complete msgpack value, 
+// which is written to the stream as is.
+type Marshaler interface {
+	MarshalMsgpack() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types which can decode themselves from msgpack.
+// UnmarshalMsgpack is passed the bytes of a single, complete msgpack value.
+// It must copy the bytes if it wishes to retain them after returning.
+// 
+// A nil in the stream is passed to UnmarshalMsgpack too (as []byte{0xc0}), 
+// except when decoding into a pointer to an Unmarshaler, which is set to nil.
+type Unmarshaler interface {
+	UnmarshalMsgpack([]byte) error
+}
+
+// RawMessage is a raw encoded msgpack value.
+// It implements Marshaler and Unmarshaler, so it can be used to delay decoding 
+// a value (e.g. until a header has been read), or to embed an already encoded value.
+// 
+// A nil RawMessage encodes as nil. Decoding a nil gives its exact bytes, 
+// RawMessage{0xc0}, not a nil RawMessage (a *RawMessage is set to nil).
+type RawMessage []byte
+
+// MarshalMsgpack returns m as the encoding of m.
+func (m RawMessage) MarshalMsgpack() ([]byte, error) {
+	if len(m) == 0 {
+		return []byte{0xc0}, nil
+	}
+	return m, nil
+}
+
+// UnmarshalMsgpack sets *m to a copy of data.
+func (m *RawMessage) UnmarshalMsgpack(data []byte) error {
+	if m == nil {
+		return errors.New("msgpack.RawMessage: UnmarshalMsgpack on nil pointer")
+	}
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
 var (
 	structInfoFieldName = "_struct"
 	
-	cachedStructFieldInfos = make(map[reflect.Type]*structFieldInfos, 4)
+	// cachedStructFieldInfos holds a map[reflect.Type]*structFieldInfos, which is 
+	// copied on write, so Encoders and Decoders read it without a lock.
+	// Writers hold cachedStructFieldInfosMutex.
+	cachedStructFieldInfos atomic.Value
 	cachedStructFieldInfosMutex sync.Mutex
 
 	nilIntfSlice = []interface{}(nil)
 	intfSliceTyp = reflect.TypeOf(nilIntfSlice)
 	intfTyp = intfSliceTyp.Elem()
 	byteSliceTyp = reflect.TypeOf([]byte(nil))
+	rawMessageTyp = reflect.TypeOf(RawMessage(nil))
+	stringTyp = reflect.TypeOf("")
+	boolTyp = reflect.TypeOf(false)
+	int64Typ = reflect.TypeOf(int64(0))
+	uint64Typ = reflect.TypeOf(uint64(0))
+	float64Typ = reflect.TypeOf(float64(0))
 	timeTyp = reflect.TypeOf(time.Time{})
+	marshalerTyp = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerTyp = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	binaryMarshalerTyp = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerTyp = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	textMarshalerTyp = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerTyp = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
 	mapStringIntfTyp = reflect.TypeOf(map[string]interface{}(nil))
 	mapIntfIntfTyp = reflect.TypeOf(map[interface{}]interface{}(nil))
 )
@@ -70,13 +135,20 @@ type structFieldInfo struct {
 	is        []int
 	tag       string
 	omitEmpty bool
+	required  bool     // decoding fails if absent from the stream
+	toArray   bool     // (_struct only) encode the struct as an array
 	encName   string   // encode name
 	encNameBs []byte
+	intKey    bool     // encode name is an integer, encoded as encInt (e.g. `msgpack:"1"`)
+	encInt    int64
 	name      string   // field name
 }
 
 type structFieldInfos struct {
 	sis []*structFieldInfo
+	numRequired int
+	numOmitEmpty int
+	toArray bool
 }
 
 func (si *structFieldInfo) field(struc reflect.Value) (rv reflect.Value) {
@@ -88,34 +160,70 @@ func (si *structFieldInfo) field(struc reflect.Value) (rv reflect.Value) {
 	return
 }
 
+func (si *structFieldInfo) fieldType(struc reflect.Type) reflect.Type {
+	if si.i > -1 {
+		return struc.Field(si.i).Type
+	}
+	return struc.FieldByIndex(si.is).Type
+}
+
 // linear search. faster than binary search in my testing up to 16-field structs.
 func (sis *structFieldInfos) getForEncName(name string) (si *structFieldInfo) {
-	for _, si = range sis.sis {
+	if j := sis.indexForEncName(name); j > -1 {
+		si = sis.sis[j]
+	}
+	return
+}
+
+// indexForIntKey returns the index in sis.sis of the field with the integer key, or -1.
+func (sis *structFieldInfos) indexForIntKey(i int64) int {
+	for j, si := range sis.sis {
+		if si.intKey && si.encInt == i {
+			return j
+		}
+	}
+	return -1
+}
+
+// indexForEncName returns the index in sis.sis of the field with the encode name, or -1.
+func (sis *structFieldInfos) indexForEncName(name string) int {
+	for j, si := range sis.sis {
 		if si.encName == name {
-			return
+			return j
 		}
 	}
-	si = nil
-	return
+	return -1
 }
 
 func getStructFieldInfos(rt reflect.Type) (sis *structFieldInfos) {
-	sis, ok := cachedStructFieldInfos[rt]
+	m0, _ := cachedStructFieldInfos.Load().(map[reflect.Type]*structFieldInfos)
+	sis, ok := m0[rt]
 	if ok {
 		return 
 	}
 	
 	cachedStructFieldInfosMutex.Lock()
 	defer cachedStructFieldInfosMutex.Unlock()
+	// another goroutine may have added it while we waited for the lock
+	m0, _ = cachedStructFieldInfos.Load().(map[reflect.Type]*structFieldInfos)
+	if sis, ok = m0[rt]; ok {
+		return
+	}
 	
 	sis = new(structFieldInfos)
 	
 	var siInfo *structFieldInfo
 	if f, ok := rt.FieldByName(structInfoFieldName); ok {
 		siInfo = parseStructFieldInfo(structInfoFieldName, f.Tag.Get("msgpack"))
+		sis.toArray = siInfo.toArray
 	}
 	rgetStructFieldInfos(rt, nil, sis, siInfo)
-	cachedStructFieldInfos[rt] = sis
+	m := make(map[reflect.Type]*structFieldInfos, len(m0) + 1)
+	for k, v := range m0 {
+		m[k] = v
+	}
+	m[rt] = sis
+	cachedStructFieldInfos.Store(m)
 	return
 }
 
@@ -151,6 +259,15 @@ func rgetStructFieldInfos(rt reflect.Type, indexstack []int, sis *structFieldInf
 			if siInfo.omitEmpty {
 				si.omitEmpty = true
 			}
+			if siInfo.required {
+				si.required = true
+			}
+		}
+		if si.required {
+			sis.numRequired++
+		}
+		if si.omitEmpty {
+			sis.numOmitEmpty++
 		}
 		sis.sis = append(sis.sis, si)
 	}
@@ -181,33 +298,72 @@ func parseStructFieldInfo(fname string, stag string) (si *structFieldInfo) {
 					si.encName = s
 				}
 			} else {
-				if s == "omitempty" {
+				switch s {
+				case "omitempty":
 					si.omitEmpty = true
+				case "required":
+					si.required = true
+				case "toarray":
+					si.toArray = true
 				}
 			}
 		}
 	}
 	si.encNameBs = []byte(si.encName)
+	// only a canonical decimal integer, so e.g. "01" or "+1" stay strings
+	if i, err := strconv.ParseInt(si.encName, 10, 64); err == nil && strconv.FormatInt(i, 10) == si.encName {
+		si.intKey, si.encInt = true, i
+	}
 	return
 }
 
-func getContainerByteDesc(ct ContainerType) (cutoff int, b0, b1, b2 byte) {
+// getContainerByteDesc returns the descriptor bytes for a container type.
+// A descriptor of 0 means the container has no such encoding
+// (e.g. bin has no fixed form, and lists/maps have no 8-bit length form).
+func getContainerByteDesc(ct ContainerType) (cutoff int, b0, b8, b16, b32 byte) {
 	switch ct {
 	case ContainerRawBytes:
 		cutoff = 32
-		b0, b1, b2 = 0xa0, 0xda, 0xdb
+		b0, b8, b16, b32 = 0xa0, 0xd9, 0xda, 0xdb
+	case ContainerBinary:
+		cutoff = 0
+		b0, b8, b16, b32 = 0, 0xc4, 0xc5, 0xc6
 	case ContainerList:
 		cutoff = 16
-		b0, b1, b2 = 0x90, 0xdc, 0xdd
+		b0, b8, b16, b32 = 0x90, 0, 0xdc, 0xdd
 	case ContainerMap:
 		cutoff = 16
-		b0, b1, b2 = 0x80, 0xde, 0xdf
+		b0, b8, b16, b32 = 0x80, 0, 0xde, 0xdf
 	default:
 		panic(fmt.Errorf("getContainerByteDesc: Unknown container type: %v", ct))
 	}
 	return
 }
 
+// decImpl records whether a type, or a pointer to it, implements an interface type.
+type decImpl struct {
+	ptr, val bool
+}
+
+func newDecImpl(rt, it reflect.Type) decImpl {
+	return decImpl{reflect.PtrTo(rt).Implements(it), rt.Implements(it)}
+}
+
+func (x decImpl) any() bool {
+	return x.ptr || x.val
+}
+
+// get returns the address of rv, or rv, if it implements the interface type.
+func (x decImpl) get(rv reflect.Value) (rvi reflect.Value, ok bool) {
+	if x.ptr && rv.CanAddr() {
+		return rv.Addr(), true
+	}
+	if x.val {
+		return rv, true
+	}
+	return
+}
+
 func reflectValue(v interface{}) (rv reflect.Value) {
 	rv, ok := v.(reflect.Value)
 	if !ok {
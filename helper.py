@@ -5,6 +5,7 @@
 # So it can process them (so we don't have to checkin the files).
 
 import msgpack, sys, os
+from collections import OrderedDict
 
 def get_test_data_list():
     # get list with all primitive types, and a combo type
@@ -64,20 +65,32 @@ def get_test_data_list():
          ]
     return l
 
-def build_test_data(destdir):
+def canonical(o, packer):
+    # order map keys by their packed bytes, as the Go Encoder does if Canonical is set.
+    if isinstance(o, dict):
+        items = [(k, canonical(v, packer)) for k, v in o.items()]
+        return OrderedDict(sorted(items, key=lambda kv: packer.pack(kv[0])))
+    if isinstance(o, list):
+        return [canonical(v, packer) for v in o]
+    return o
+
+def build_test_data(destdir, legacy):
     l = get_test_data_list()
     for i in range(len(l)):
-        packer = msgpack.Packer()
-        serialized = packer.pack(l[i])
+        # legacy: write raw (no str8/bin), as in the original msgpack format.
+        packer = msgpack.Packer(use_bin_type=not legacy)
+        serialized = packer.pack(canonical(l[i], packer))
         f = open(os.path.join(destdir, str(i) + '.golden'), 'wb')
         f.write(serialized)
         f.close()
 
 def doMain(args):
     if len(args) == 2 and args[0] == "testdata":
-        build_test_data(args[1])
+        build_test_data(args[1], False)
+    elif len(args) == 3 and args[0] == "testdata" and args[2] == "legacy":
+        build_test_data(args[1], True)
     else:
-        print("Usage: build.py [testdata]")
+        print("Usage: helper.py testdata <destdir> [legacy]")
     
 if __name__ == "__main__":
     doMain(sys.argv[1:])
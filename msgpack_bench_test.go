@@ -111,6 +111,7 @@ func benchCheck() {
 
 func fnBenchmarkEncode(b *testing.B, encfn benchFn) {
 	//benchOnce.Do(benchInit)
+	b.ReportAllocs()
 	runtime.GC()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -133,6 +134,7 @@ func fnBenchmarkDecode(b *testing.B, encfn benchFn, decfn benchFn) {
 	}
 	encLen := buf.Len()
 	benchBs = benchBs[0:encLen]
+	b.ReportAllocs()
 	runtime.GC()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -158,6 +160,11 @@ func fnMsgpackDecodeFn(buf *bytes.Buffer, ts *TestStruc) error {
 	return NewDecoder(buf, testDecOpts(nil, nil, false, false, false)).Decode(ts)
 }
 
+// fnMsgpackDecodeBytesFn decodes directly from the []byte, instead of through an io.Reader.
+func fnMsgpackDecodeBytesFn(buf *bytes.Buffer, ts *TestStruc) error {
+	return NewDecoderBytes(buf.Bytes(), testDecOpts(nil, nil, false, false, false)).Decode(ts)
+}
+
 func fnGobEncodeFn(buf *bytes.Buffer, ts *TestStruc) error {
 	return gob.NewEncoder(buf).Encode(ts)
 }
@@ -186,6 +193,154 @@ func fnBsonDecodeFn(buf *bytes.Buffer, ts *TestStruc) error {
 	return bson.Unmarshal(buf.Bytes(), ts)
 }
 
+// Decode into a struct with none of the fields in the stream, so all are skipped.
+func Benchmark__Msgpack__DecodeSkip(b *testing.B) {
+	b.ReportAllocs()
+	benchBs = benchBs[0:0]
+	buf := bytes.NewBuffer(benchBs)
+	if err := fnMsgpackEncodeFn(buf, &benchTs); err != nil {
+		logT(b, "Error encoding benchTs: %v", err)
+		b.FailNow()
+	}
+	benchBs = benchBs[0:buf.Len()]
+	runtime.GC()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var ts struct{ Unknown int }
+		buf = bytes.NewBuffer(benchBs)
+		if err := NewDecoder(buf, nil).Decode(&ts); err != nil {
+			logT(b, "Error decoding into unknown struct: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+// benchSmallStruc is encoded and decoded many times per op (in a slice), 
+// so the per-value cost of finding how to encode/decode each type dominates.
+type benchSmallStruc struct {
+	A int64
+	B string
+	C float64
+	D bool
+	E []int16
+}
+
+func benchSmallStrucs() []benchSmallStruc {
+	vs := make([]benchSmallStruc, 100)
+	for j := range vs {
+		vs[j] = benchSmallStruc{int64(j), "some string", float64(j) / 3, j % 2 == 0, []int16{1, 2, 3}}
+	}
+	return vs
+}
+
+func Benchmark__Msgpack__EncodeSmallStructs(b *testing.B) {
+	vs := benchSmallStrucs()
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	runtime.GC()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := NewEncoder(&buf).Encode(vs); err != nil {
+			logT(b, "Error encoding: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+func Benchmark__Msgpack__EncodeSmallStructsAppend(b *testing.B) {
+	vs := benchSmallStrucs()
+	var bs []byte
+	var err error
+	b.ReportAllocs()
+	runtime.GC()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if bs, err = MarshalAppend(bs[:0], vs); err != nil {
+			logT(b, "Error encoding: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+func Benchmark__Msgpack__EncodeSmallStructsBytes(b *testing.B) {
+	vs := benchSmallStrucs()
+	enc := NewEncoderBytes(nil, nil)
+	b.ReportAllocs()
+	runtime.GC()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enc.ResetBytes(enc.Bytes()[:0])
+		if err := enc.Encode(vs); err != nil {
+			logT(b, "Error encoding: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+// Benchmark__Msgpack__MarshalSmallStruct and Benchmark__Msgpack__UnmarshalSmallStruct 
+// measure the per-message cost of Marshal and Unmarshal for a small message.
+func Benchmark__Msgpack__MarshalSmallStruct(b *testing.B) {
+	v := &benchSmallStrucs()[1]
+	b.ReportAllocs()
+	runtime.GC()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(v); err != nil {
+			logT(b, "Error encoding: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+func Benchmark__Msgpack__UnmarshalSmallStruct(b *testing.B) {
+	bs, err := Marshal(benchSmallStrucs()[1])
+	if err != nil {
+		logT(b, "Error encoding: %v", err)
+		b.FailNow()
+	}
+	b.ReportAllocs()
+	runtime.GC()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v benchSmallStruc
+		if err = Unmarshal(bs, &v, nil); err != nil {
+			logT(b, "Error decoding: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+func fnBenchmarkDecodeSmallStructs(b *testing.B, newDec func(bs []byte) *Decoder) {
+	bs, err := Marshal(benchSmallStrucs())
+	if err != nil {
+		logT(b, "Error encoding: %v", err)
+		b.FailNow()
+	}
+	b.ReportAllocs()
+	runtime.GC()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var vs []benchSmallStruc
+		if err = newDec(bs).Decode(&vs); err != nil {
+			logT(b, "Error decoding: %v", err)
+			b.FailNow()
+		}
+	}
+}
+
+func Benchmark__Msgpack__DecodeSmallStructs(b *testing.B) {
+	fnBenchmarkDecodeSmallStructs(b, func(bs []byte) *Decoder {
+		return NewDecoder(bytes.NewReader(bs), nil)
+	})
+}
+
+func Benchmark__Msgpack__DecodeSmallStructsBytes(b *testing.B) {
+	fnBenchmarkDecodeSmallStructs(b, func(bs []byte) *Decoder {
+		return NewDecoderBytes(bs, nil)
+	})
+}
+
 func Benchmark__Msgpack__Encode(b *testing.B) {
 	fnBenchmarkEncode(b, fnMsgpackEncodeFn)
 }
@@ -206,6 +361,10 @@ func Benchmark__Msgpack__Decode(b *testing.B) {
 	fnBenchmarkDecode(b, fnMsgpackEncodeFn, fnMsgpackDecodeFn)
 }
 
+func Benchmark__Msgpack__DecodeBytes(b *testing.B) {
+	fnBenchmarkDecode(b, fnMsgpackEncodeFn, fnMsgpackDecodeBytesFn)
+}
+
 func Benchmark__Gob______Decode(b *testing.B) {
 	fnBenchmarkDecode(b, fnGobEncodeFn, fnGobDecodeFn)
 }
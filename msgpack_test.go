@@ -48,7 +48,13 @@ package msgpack
 
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"reflect"
+	"runtime"
 	"testing"
 	"net/rpc"
 	"bytes"
@@ -58,6 +64,9 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"net"
 )
 
@@ -125,6 +134,23 @@ func (r *TestRpcInt) Update(n int, res *int) error { r.i = n; *res = r.i; return
 func (r *TestRpcInt) Square(ignore int, res *int) error { *res = r.i * r.i; return nil }
 func (r *TestRpcInt) Mult(n int, res *int) error { *res = r.i * n; return nil }
 
+type TestRpcNotify struct {
+	ch chan string
+}
+
+func (r *TestRpcNotify) Note(s string, res *int) error { r.ch <- s; *res = len(s); return nil }
+
+type TestRpcSvc struct {
+	notes chan string
+}
+
+func (r *TestRpcSvc) Concat(a, b string) string { return a + b }
+func (r *TestRpcSvc) Double(n int, res *int) error { *res = 2 * n; return nil }
+func (r *TestRpcSvc) Note(s string) { r.notes <- s }
+func (r *TestRpcSvc) Bad() (int, int) { return 0, 0 }
+
+type testCtxKey struct{}
+
 func init() {
 	primitives := []interface{} {
 		int8(-8),
@@ -577,10 +603,249 @@ func testRpc(t *testing.T, callClose, doBasic, doCustom, doExit bool) {
 	}
 }
 
+func TestCustomRpcNotify(t *testing.T) {
+	rcvr := &TestRpcNotify{make(chan string, 1)}
+	srv := rpc.NewServer()
+	checkErrT(t, srv.Register(rcvr))
+	
+	// the server dispatches notifications, without writing a response
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	sc := NewCustomRPCServerCodec(c2, nil)
+	go srv.ServeCodec(sc)
+	enc := NewEncoder(c1)
+	checkErrT(t, enc.Encode([]interface{}{2, "TestRpcNotify.Note", []interface{}{"a"}}))
+	checkEqualT(t, <-rcvr.ch, "a")
+	// notifications for unknown methods get no response either
+	checkErrT(t, enc.Encode([]interface{}{2, "TestRpcNotify.None", []interface{}{"a"}}))
+	checkErrT(t, enc.Encode([]interface{}{0, 7, "TestRpcNotify.Note", []interface{}{"bc"}}))
+	checkEqualT(t, <-rcvr.ch, "bc")
+	var resp []interface{}
+	dec := NewDecoder(c1, testDecOpts(nil, nil, true, true, true))
+	checkErrT(t, dec.Decode(&resp))
+	checkEqualT(t, fmt.Sprint(resp), "[1 7 <nil> 2]")
+	c1.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var x interface{}
+	if err := dec.Decode(&x); !errors.Is(err, os.ErrDeadlineExceeded) {
+		logT(t, "------- Expecting no more responses. Got: %v, %v", x, err)
+		t.FailNow()
+	}
+	c1.SetReadDeadline(time.Time{})
+	
+	// a client sends notifications, and receives them from the server 
+	cc := NewCustomRPCClientCodec(c1, nil)
+	cl := rpc.NewClientWithCodec(cc)
+	notes := make(chan []interface{}, 1)
+	// set while the client reads responses
+	cc.(CustomRPCCodec).OnNotify(func(method string, params RawMessage) {
+		var v []interface{}
+		checkErrT(t, Unmarshal(params, &v, testDecOpts(nil, nil, true, true, true)))
+		notes <- append([]interface{}{method}, v...)
+	})
+	checkErrT(t, cc.(CustomRPCCodec).Notify("TestRpcNotify.Note", "def"))
+	checkEqualT(t, <-rcvr.ch, "def")
+	checkErrT(t, sc.(CustomRPCCodec).Notify("hello", 1, "a"))
+	checkEqualT(t, fmt.Sprint(<-notes), "[hello 1 a]")
+	var n int
+	go func() { <-rcvr.ch }()
+	checkErrT(t, cl.Call("TestRpcNotify.Note", "ghij", &n))
+	checkEqualT(t, n, 4)
+	checkErrT(t, cl.Close())
+	
+	// a notification cut short is the end of the stream
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	cc = NewCustomRPCClientCodec(c1, nil)
+	go func() {
+		c2.Write([]byte{0x93, 2, 0xa1, 'h', 0x92, 1})
+		c2.Close()
+	}()
+	var resp1 rpc.Response
+	checkEqualT(t, cc.ReadResponseHeader(&resp1), io.EOF)
+	
+	// as is a request or notification header, on the server
+	for _, b := range [][]byte{{0x94, 0, 7, 0xa5, 'A'}, {0x93, 2, 0xa5, 'A'}} {
+		c1, c2 = net.Pipe()
+		sc = NewCustomRPCServerCodec(c1, nil)
+		go func() {
+			c2.Write(b)
+			c2.Close()
+		}()
+		var req rpc.Request
+		checkEqualT(t, sc.ReadRequestHeader(&req), io.EOF)
+		sc.Close()
+	}
+}
+
+func TestServer(t *testing.T) {
+	svc := &TestRpcSvc{make(chan string, 1)}
+	srv := NewServer(testDecOpts(nil, nil, true, true, true))
+	checkErrT(t, srv.Register(svc))
+	checkErrT(t, srv.RegisterFunc("add", func(a, b int) int { return a + b }))
+	checkErrT(t, srv.RegisterFunc("sum", func(ctx context.Context, prefix string, xs ...int64) (string, error) {
+		n := ctx.Value(testCtxKey{}).(int64)
+		for _, x := range xs {
+			n += x
+		}
+		return prefix + strconv.FormatInt(n, 10), nil
+	}))
+	checkErrT(t, srv.RegisterFunc("fail", func() error { return errors.New("failed") }))
+	checkErrT(t, srv.RegisterFunc("panic", func(m map[string]int) int { m["a"]++; return m["a"] }))
+	if err := srv.RegisterFunc("add", func() {}); err == nil {
+		logT(t, "------- Expecting error registering add twice")
+		t.FailNow()
+	}
+	
+	c1, c2 := net.Pipe()
+	ctx := context.WithValue(context.Background(), testCtxKey{}, int64(100))
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeConnContext(ctx, c2) }()
+	enc := NewEncoder(c1)
+	dec := NewDecoder(c1, testDecOpts(nil, nil, true, true, true))
+	call := func(method string, params ...interface{}) (res []interface{}) {
+		checkErrT(t, enc.Encode([]interface{}{0, 9, method, params}))
+		checkErrT(t, dec.Decode(&res))
+		return
+	}
+	for _, x := range []struct{
+		method string
+		params []interface{}
+		res string // the response, as formatted by fmt.Sprint
+	}{
+		{"add", []interface{}{1, 2}, "[1 9 <nil> 3]"},
+		{"TestRpcSvc.Concat", []interface{}{"a", "b"}, "[1 9 <nil> ab]"},
+		{"TestRpcSvc.Double", []interface{}{21}, "[1 9 <nil> 42]"},
+		{"sum", []interface{}{"n="}, "[1 9 <nil> n=100]"},
+		{"sum", []interface{}{"n=", 1, 2, 3}, "[1 9 <nil> n=106]"},
+		{"fail", nil, "[1 9 failed <nil>]"},
+		{"TestRpcSvc.Bad", nil, "[1 9 msgpack-rpc: can't find method TestRpcSvc.Bad <nil>]"},
+		{"add", []interface{}{1}, "[1 9 msgpack-rpc: add: expecting 2 params. Got: 1 <nil>]"},
+		{"sum", nil, "[1 9 msgpack-rpc: sum: expecting at least 1 params. Got: 0 <nil>]"},
+	} {
+		checkEqualT(t, fmt.Sprint(call(x.method, x.params...)), x.res)
+	}
+	// errors decoding params, or in the function
+	for _, x := range []struct{
+		method string
+		params []interface{}
+	}{
+		{"add", []interface{}{1, "x"}},
+		{"panic", []interface{}{nil}},
+	} {
+		res := call(x.method, x.params...)
+		if e, _ := res[2].(string); !strings.HasPrefix(e, "msgpack-rpc: " + x.method + ": ") && 
+			!strings.HasPrefix(e, "msgpack-rpc: panic in " + x.method) {
+			logT(t, "------- Expecting error. Got: %v", res)
+			t.FailNow()
+		}
+	}
+	// notifications get no response
+	checkErrT(t, enc.Encode([]interface{}{2, "TestRpcSvc.Note", []interface{}{"n"}}))
+	checkEqualT(t, <-svc.notes, "n")
+	checkErrT(t, enc.Encode([]interface{}{2, "none", []interface{}{}}))
+	checkEqualT(t, fmt.Sprint(call("add", 4, 5)), "[1 9 <nil> 9]")
+	c1.Close()
+	checkErrT(t, <-done)
+	
+	// the client codec for net/rpc works with the Server
+	c1, c2 = net.Pipe()
+	go srv.ServeConn(c2)
+	cl := rpc.NewClientWithCodec(NewCustomRPCClientCodec(c1, nil))
+	var n int
+	checkErrT(t, cl.Call("TestRpcSvc.Double", 21, &n))
+	checkEqualT(t, n, 42)
+	checkErrT(t, cl.Close())
+}
+
 // Comprehensive testing that generates data encoded from python msgpack, 
 // and validates that our code can read and write it out accordingly.
+func TestServerLimits(t *testing.T) {
+	started, release := make(chan bool, 4), make(chan struct{})
+	srv := NewServerWithOptions(nil, &ServerOptions{DecoderOptions: DefaultServerOptions.DecoderOptions, MaxPending: 2})
+	checkErrT(t, srv.RegisterFunc("block", func() { started <- true; <-release }))
+	checkErrT(t, srv.RegisterFunc("wait", func(ctx context.Context) error {
+		started <- true
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	
+	// a 12-byte request announcing 256MB of params
+	c1, c2 := net.Pipe()
+	done := make(chan error, 1)
+	var ms0, ms1 runtime.MemStats
+	runtime.ReadMemStats(&ms0)
+	go func() { done <- srv.ServeConn(c2) }()
+	c1.Write([]byte{0x94, 0, 1, 0xa3, 'a', 'd', 'd', 0xc6, 0x10, 0, 0, 0})
+	err := <-done
+	runtime.ReadMemStats(&ms1)
+	var lerr *LimitError
+	if !errors.As(err, &lerr) {
+		logT(t, "------- Expecting LimitError. Got: %v", err)
+		t.FailNow()
+	}
+	if n := ms1.TotalAlloc - ms0.TotalAlloc; n > 1 << 20 {
+		logT(t, "------- Serving a 12-byte request allocated %d bytes", n)
+		t.FailNow()
+	}
+	
+	// MaxBytes bounds a whole message, not each part of it
+	opts := ServerOptions{DecoderOptions: DefaultServerOptions.DecoderOptions}
+	opts.DecoderOptions.MaxBytes = 64
+	srv2 := NewServerWithOptions(nil, &opts)
+	checkErrT(t, srv2.RegisterFunc(strings.Repeat("m", 40), func(s string) {}))
+	c1, c2 = net.Pipe()
+	go func() { done <- srv2.ServeConn(c2) }()
+	go NewEncoder(c1).Encode([]interface{}{2, strings.Repeat("m", 40), []string{strings.Repeat("p", 40)}})
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		err = errors.New("no error after 5s")
+	}
+	if !errors.As(err, &lerr) || lerr.Limit != "MaxBytes" {
+		logT(t, "------- Expecting MaxBytes LimitError. Got: %v", err)
+		t.FailNow()
+	}
+	c1.Close()
+	
+	// at most MaxPending requests are served at a time
+	c1, c2 = net.Pipe()
+	go func() { done <- srv.ServeConn(c2) }()
+	enc := NewEncoder(c1)
+	go func() {
+		for i := 0; i < 3; i++ {
+			enc.Encode([]interface{}{2, "block", []interface{}{}})
+		}
+	}()
+	<-started
+	<-started
+	select {
+	case <-started:
+		logT(t, "------- Expecting at most 2 pending requests")
+		t.FailNow()
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-started
+	
+	// functions' context is canceled when the connection is closed
+	checkErrT(t, enc.Encode([]interface{}{0, 1, "wait", []interface{}{}}))
+	<-started
+	c1.Close()
+	checkErrT(t, <-done)
+}
+
 func TestPythonGenStreams(t *testing.T) {
-	logT(t, "TestPythonGenStreams")
+	doTestPythonGenStreams(t, false)
+}
+
+// Same as TestPythonGenStreams, but python writes the legacy raw format, 
+// and we encode with EncoderOptions.LegacyRaw.
+func TestPythonGenStreamsLegacyRaw(t *testing.T) {
+	doTestPythonGenStreams(t, true)
+}
+
+func doTestPythonGenStreams(t *testing.T, legacy bool) {
+	logT(t, "TestPythonGenStreams: legacy: %v", legacy)
 	tmpdir, err := ioutil.TempDir("", "golang-msgpack-test") 
 	if err != nil {
 		logT(t, "-------- Unable to create temp directory\n")
@@ -588,7 +853,11 @@ func TestPythonGenStreams(t *testing.T) {
 	}
 	defer os.RemoveAll(tmpdir)
 	logT(t, "tmpdir: %v", tmpdir)
-	cmd := exec.Command("python", "helper.py", "testdata", tmpdir)
+	cmdArgs := []string{"helper.py", "testdata", tmpdir}
+	if legacy {
+		cmdArgs = append(cmdArgs, "legacy")
+	}
+	cmd := exec.Command("python", cmdArgs...)
 	//cmd.Stdin = strings.NewReader("some input")
 	//cmd.Stdout = &out
 	var cmdout []byte
@@ -635,7 +904,8 @@ func TestPythonGenStreams(t *testing.T) {
 			failT(t)
 		}
 		bsb := new(bytes.Buffer)
-		if err = NewEncoder(bsb).Encode(v1); err != nil {
+		// helper.py writes maps in canonical order, so the bytes match for maps too.
+		if err = NewEncoderWithOptions(bsb, &EncoderOptions{LegacyRaw: legacy, Canonical: true}).Encode(v1); err != nil {
 			logT(t, "Error encoding to stream: %d: Err: %v", i, err)
 			failT(t)
 			continue
@@ -643,20 +913,1375 @@ func TestPythonGenStreams(t *testing.T) {
 		if reflect.DeepEqual(bsb.Bytes(), bss) { 
 			logT(t, "++++++++ Bytes match")
 		} else {
-			logT(t, "???????? Bytes do not match")
-			xs := "--------"
-			if reflect.ValueOf(v).Kind() == reflect.Map {
-				xs = "        "
-				logT(t, "%s It's a map. Ok that they don't match (dependent on ordering).", xs)
-			} else {
-				logT(t, "%s It's not a map. They should match.", xs)
-				failT(t)
+			logT(t, "-------- Bytes do not match")
+			logT(t, "--------   FROM_FILE: %4d] %v", len(bss), bss)
+			logT(t, "--------     ENCODED: %4d] %v", len(bsb.Bytes()), bsb.Bytes())
+			failT(t)
+		}
+	}
+	
+}
+
+func TestStrBinSpec(t *testing.T) {
+	s40 := strings.Repeat("s", 40)
+	bs300 := bytes.Repeat([]byte{'b'}, 300)
+	bs70000 := bytes.Repeat([]byte{'B'}, 70000)
+	
+	// check that we write the smallest str/bin descriptor
+	for _, x := range []struct{ v interface{}; prefix []byte }{
+		{"abc", []byte{0xa3}},
+		{s40, []byte{0xd9, 40}},
+		{[]byte("abc"), []byte{0xc4, 3}},
+		{[3]byte{1, 2, 3}, []byte{0xc4, 3}},
+		{bs300, []byte{0xc5, 0x01, 0x2c}},
+		{bs70000, []byte{0xc6, 0x00, 0x01, 0x11, 0x70}},
+		{struct{ A int }{1}, []byte{0x81, 0xa1, 'A', 1}}, // field names are str
+	} {
+		b, err := Marshal(x.v)
+		checkErrT(t, err)
+		checkEqualT(t, b[:len(x.prefix)], x.prefix)
+	}
+	
+	// str and bin decode into a nil interface{} as string and []byte respectively
+	for _, x := range []struct{ b []byte; v interface{} }{
+		{append([]byte{0xd9, 40}, s40...), s40},
+		{[]byte{0xc4, 3, 'a', 'b', 'c'}, []byte("abc")},
+		{append([]byte{0xc5, 0x01, 0x2c}, bs300...), bs300},
+		{append([]byte{0xc6, 0x00, 0x01, 0x11, 0x70}, bs70000...), bs70000},
+	} {
+		var v interface{}
+		checkErrT(t, Unmarshal(x.b, &v, nil))
+		checkEqualT(t, v, x.v)
+	}
+	
+	// str and bin are interchangeable when decoding into a string or []byte
+	var s string
+	checkErrT(t, Unmarshal([]byte{0xc4, 3, 'a', 'b', 'c'}, &s, nil))
+	checkEqualT(t, s, "abc")
+	var bs []byte
+	checkErrT(t, Unmarshal(append([]byte{0xd9, 40}, s40...), &bs, nil))
+	checkEqualT(t, bs, []byte(s40))
+}
+
+func TestLegacyRaw(t *testing.T) {
+	s40 := strings.Repeat("s", 40)
+	opts := EncoderOptions{LegacyRaw: true}
+	for _, x := range []struct{ v interface{}; prefix []byte }{
+		{"abc", []byte{0xa3}},
+		{s40, []byte{0xda, 0, 40}},
+		{[]byte("abc"), []byte{0xa3}},
+	} {
+		bsb := new(bytes.Buffer)
+		checkErrT(t, NewEncoderWithOptions(bsb, &opts).Encode(x.v))
+		checkEqualT(t, bsb.Bytes()[:len(x.prefix)], x.prefix)
+		
+		// legacy raw is decoded transparently
+		v := reflect.New(reflect.TypeOf(x.v))
+		checkErrT(t, Unmarshal(bsb.Bytes(), v.Interface(), nil))
+		checkEqualT(t, v.Elem().Interface(), x.v)
+	}
+}
+
+type testExtPoint struct {
+	X, Y int16
+}
+
+func TestExt(t *testing.T) {
+	err := RegisterExt(5, reflect.TypeOf(testExtPoint{}),
+		func(rv reflect.Value) ([]byte, error) {
+			p := rv.Interface().(testExtPoint)
+			return []byte{byte(p.X >> 8), byte(p.X), byte(p.Y >> 8), byte(p.Y)}, nil
+		},
+		func(rv reflect.Value, data []byte) error {
+			if len(data) != 4 {
+				return fmt.Errorf("testExtPoint: expecting 4 bytes. Got: %d", len(data))
 			}
-			logT(t, "%s   FROM_FILE: %4d] %v", xs, len(bss), bss)
-			logT(t, "%s     ENCODED: %4d] %v", xs, len(bsb.Bytes()), bsb.Bytes())
+			rv.Set(reflect.ValueOf(testExtPoint{
+				int16(data[0]) << 8 | int16(data[1]), int16(data[2]) << 8 | int16(data[3])}))
+			return nil
+		})
+	checkErrT(t, err)
+	if err = RegisterExt(5, reflect.TypeOf(int(0)), 
+		func(reflect.Value) ([]byte, error) { return nil, nil },
+		func(reflect.Value, []byte) error { return nil }); err == nil {
+		logT(t, "------- Expecting error re-registering type code 5 for a different type")
+		t.FailNow()
+	}
+	if err = RegisterExt(-2, reflect.TypeOf(int(0)), 
+		func(reflect.Value) ([]byte, error) { return nil, nil },
+		func(reflect.Value, []byte) error { return nil }); err == nil {
+		logT(t, "------- Expecting error registering reserved type code -2")
+		t.FailNow()
+	}
+	
+	p := testExtPoint{-2, 300}
+	b, err := Marshal(p)
+	checkErrT(t, err)
+	checkEqualT(t, b, []byte{0xd6, 5, 0xff, 0xfe, 0x01, 0x2c})
+	
+	var p2 testExtPoint
+	checkErrT(t, Unmarshal(b, &p2, nil))
+	checkEqualT(t, p2, p)
+	
+	// registered type code decodes into its Go type; unregistered into a RawExt.
+	v := []interface{}{p, RawExt{9, []byte("abc")}, RawExt{10, nil}}
+	b, err = Marshal(v)
+	checkErrT(t, err)
+	var v2 interface{}
+	checkErrT(t, Unmarshal(b, &v2, nil))
+	checkEqualT(t, v2, []interface{}{p, RawExt{9, []byte("abc")}, RawExt{10, []byte{}}})
+	
+	// extensions within typed containers
+	type extHolder struct {
+		P testExtPoint
+		Pp *testExtPoint
+		M map[string]testExtPoint
+		R RawExt
+	}
+	h := extHolder{P: p, Pp: &p, M: map[string]testExtPoint{"a": p}, R: RawExt{9, bytes.Repeat([]byte{1}, 300)}}
+	b, err = Marshal(h)
+	checkErrT(t, err)
+	var h2 extHolder
+	checkErrT(t, Unmarshal(b, &h2, nil))
+	checkEqualT(t, h2, h)
+}
+
+func TestTimeExt(t *testing.T) {
+	opts := EncoderOptions{TimeExt: true}
+	for _, x := range []struct{ v time.Time; prefix []byte }{
+		{time.Unix(1000, 0).UTC(), []byte{0xd6, 0xff}},        // timestamp32
+		{timeToCompare, []byte{0xd7, 0xff}},                   // timestamp64
+		{time.Unix(-1000, 500).UTC(), []byte{0xc7, 12, 0xff}}, // timestamp96
+		{time.Date(2600, 1, 1, 0, 0, 0, 1, time.UTC), []byte{0xc7, 12, 0xff}},
+	} {
+		bsb := new(bytes.Buffer)
+		checkErrT(t, NewEncoderWithOptions(bsb, &opts).Encode(x.v))
+		checkEqualT(t, bsb.Bytes()[:len(x.prefix)], x.prefix)
+		
+		var tt time.Time
+		checkErrT(t, Unmarshal(bsb.Bytes(), &tt, nil))
+		checkEqualT(t, tt, x.v)
+		var v interface{}
+		checkErrT(t, Unmarshal(bsb.Bytes(), &v, nil))
+		checkEqualT(t, v, x.v)
+	}
+	
+	// the legacy 2-element array still decodes into a time.Time
+	b, err := Marshal(timeToCompare)
+	checkErrT(t, err)
+	var tt time.Time
+	checkErrT(t, Unmarshal(b, &tt, nil))
+	checkEqualT(t, tt, timeToCompare)
+}
+
+// testMarshalID has value receiver for MarshalMsgpack, and pointer receiver for UnmarshalMsgpack.
+type testMarshalID [4]byte
+
+func (x testMarshalID) MarshalMsgpack() ([]byte, error) {
+	return Marshal(fmt.Sprintf("%x", x[:]))
+}
+
+func (x *testMarshalID) UnmarshalMsgpack(bs []byte) (err error) {
+	var s string
+	if err = Unmarshal(bs, &s, nil); err != nil {
+		return
+	}
+	var bs2 []byte
+	if _, err = fmt.Sscanf(s, "%x", &bs2); err == nil {
+		copy(x[:], bs2)
+	}
+	return
+}
+
+// testMarshalDecimal has pointer receivers, and unexported fields.
+type testMarshalDecimal struct {
+	units int64
+	scale int8
+}
+
+func (x *testMarshalDecimal) MarshalMsgpack() ([]byte, error) {
+	return Marshal([]int64{x.units, int64(x.scale)})
+}
+
+func (x *testMarshalDecimal) UnmarshalMsgpack(bs []byte) (err error) {
+	var v []int64
+	if err = Unmarshal(bs, &v, nil); err == nil {
+		x.units, x.scale = v[0], int8(v[1])
+	}
+	return
+}
+
+func TestMarshaler(t *testing.T) {
+	id := testMarshalID{0xde, 0xad, 0xbe, 0xef}
+	b, err := Marshal(id)
+	checkErrT(t, err)
+	checkEqualT(t, b, append([]byte{0xa8}, "deadbeef"...))
+	var id2 testMarshalID
+	checkErrT(t, Unmarshal(b, &id2, nil))
+	checkEqualT(t, id2, id)
+	
+	type marshalHolder struct {
+		ID testMarshalID
+		Dec testMarshalDecimal
+		Decp *testMarshalDecimal
+		Decs []testMarshalDecimal
+		M map[string]*testMarshalDecimal
+		After string
+	}
+	dec := testMarshalDecimal{12345, 2}
+	h := marshalHolder{
+		ID: id, Dec: dec, Decp: &dec, 
+		Decs: []testMarshalDecimal{dec, {-1, 0}}, 
+		M: map[string]*testMarshalDecimal{"a": &dec},
+		After: "after",
+	}
+	// Dec is not addressable here, so pointer receiver must work on a copy
+	b, err = Marshal(h)
+	checkErrT(t, err)
+	var h2 marshalHolder
+	checkErrT(t, Unmarshal(b, &h2, nil))
+	checkEqualT(t, h2, h)
+	
+	// a non-msgpack-aware decoder sees what MarshalMsgpack wrote
+	var v map[string]interface{}
+	checkErrT(t, Unmarshal(b, &v, testDecOpts(nil, nil, true, true, true)))
+	checkEqualT(t, v["Dec"], []interface{}{int16(12345), int8(2)})
+}
+
+// testBinaryPoint implements encoding.BinaryMarshaler/BinaryUnmarshaler only.
+type testBinaryPoint struct {
+	X, Y uint8
+}
+
+func (x testBinaryPoint) MarshalBinary() ([]byte, error) {
+	return []byte{x.X, x.Y}, nil
+}
+
+func (x *testBinaryPoint) UnmarshalBinary(bs []byte) error {
+	if len(bs) != 2 {
+		return fmt.Errorf("testBinaryPoint: expecting 2 bytes. Got: %d", len(bs))
+	}
+	x.X, x.Y = bs[0], bs[1]
+	return nil
+}
+
+func TestBinaryTextMarshaler(t *testing.T) {
+	type holder struct {
+		IP net.IP
+		P testBinaryPoint
+		Ps []*testBinaryPoint
+		T time.Time
+	}
+	h := holder{net.ParseIP("10.1.2.3"), testBinaryPoint{1, 2}, 
+		[]*testBinaryPoint{{3, 4}}, timeToCompare}
+	b, err := Marshal(h)
+	checkErrT(t, err)
+	var h2 holder
+	checkErrT(t, Unmarshal(b, &h2, nil))
+	checkEqualT(t, h2, h)
+	
+	// IP is written as text, P as bin. time.Time is unaffected.
+	var v map[string]interface{}
+	checkErrT(t, Unmarshal(b, &v, testDecOpts(nil, nil, true, true, true)))
+	checkEqualT(t, v["IP"], "10.1.2.3")
+	checkEqualT(t, v["P"], []byte{1, 2})
+	checkEqualT(t, v["T"], []interface{}{int32(1328148122), int16(2000)})
+	
+	// when disabled, values are reflected as usual
+	eopts := DefaultEncoderOptions
+	eopts.BinaryMarshaler, eopts.TextMarshaler = false, false
+	bsb := new(bytes.Buffer)
+	checkErrT(t, NewEncoderWithOptions(bsb, &eopts).Encode(h))
+	v = nil
+	checkErrT(t, Unmarshal(bsb.Bytes(), &v, testDecOpts(nil, nil, true, true, true)))
+	checkEqualT(t, v["P"], map[interface{}]interface{}{"X": int8(1), "Y": int8(2)})
+	
+	// a map in the stream (not str/bin) is still decoded by reflection
+	var h3 holder
+	checkErrT(t, Unmarshal(bsb.Bytes(), &h3, nil))
+	checkEqualT(t, h3, h)
+	
+	// when disabled, a str cannot be decoded into a net.IP
+	dopts := DefaultDecoderOptions
+	dopts.TextUnmarshaler = false
+	var h4 holder
+	if err = NewDecoderWithOptions(bytes.NewBuffer(b), nil, &dopts).Decode(&h4); err == nil {
+		logT(t, "------- Expecting error decoding str into net.IP without TextUnmarshaler")
+		t.FailNow()
+	}
+}
+
+func TestEncoderWrite(t *testing.T) {
+	bsb := new(bytes.Buffer)
+	enc := NewEncoder(bsb)
+	checkErrT(t, enc.WriteArrayHeader(11))
+	checkErrT(t, enc.WriteInt(-300))
+	checkErrT(t, enc.WriteUint(300))
+	checkErrT(t, enc.WriteFloat32(1.5))
+	checkErrT(t, enc.WriteFloat64(-2.5))
+	checkErrT(t, enc.WriteString("abc"))
+	checkErrT(t, enc.WriteBytes([]byte{1, 2}))
+	checkErrT(t, enc.WriteNil())
+	checkErrT(t, enc.WriteBool(true))
+	checkErrT(t, enc.WriteExt(9, []byte{7}))
+	checkErrT(t, enc.WriteMapHeader(1))
+	checkErrT(t, enc.WriteString("k"))
+	checkErrT(t, enc.Encode([]int{1, 2}))
+	checkErrT(t, enc.Encode(map[string]bool{"x": true}))
+	
+	var v interface{}
+	checkErrT(t, Unmarshal(bsb.Bytes(), &v, testDecOpts(mapStringIntfTyp, nil, true, true, true)))
+	checkEqualT(t, v, []interface{}{
+		int16(-300), uint16(300), float32(1.5), float64(-2.5), "abc", []byte{1, 2}, nil, true,
+		RawExt{9, []byte{7}},
+		map[string]interface{}{"k": []interface{}{int8(1), int8(2)}},
+		map[string]interface{}{"x": true},
+	})
+}
+
+func TestDecoderRead(t *testing.T) {
+	v := []interface{}{
+		map[string]interface{}{"id": 7},
+		int64(-300), uint64(math.MaxUint64), float32(1.5), true, "abc", []byte{1, 2}, nil,
+		RawExt{9, []byte{7}},
+		[]interface{}{"skipped", map[string]int{"a": 1}, RawExt{10, []byte{1, 2, 3}}},
+		"last",
+	}
+	b, err := Marshal(v)
+	checkErrT(t, err)
+	dec := NewDecoder(bytes.NewBuffer(b), nil)
+	
+	vt, err := dec.PeekType()
+	checkErrT(t, err)
+	checkEqualT(t, vt, ValueArray)
+	n, err := dec.ReadArrayHeader()
+	checkErrT(t, err)
+	checkEqualT(t, n, len(v))
+	
+	// decode a value after peeking its type
+	vt, err = dec.PeekType()
+	checkErrT(t, err)
+	checkEqualT(t, vt, ValueMap)
+	var m map[string]int
+	checkErrT(t, dec.Decode(&m))
+	checkEqualT(t, m, map[string]int{"id": 7})
+	
+	i, err := dec.ReadInt()
+	checkErrT(t, err)
+	checkEqualT(t, i, int64(-300))
+	if _, err = dec.PeekType(); err != nil {
+		t.FailNow()
+	}
+	if _, err = dec.ReadInt(); err == nil {
+		logT(t, "------- Expecting overflow error reading MaxUint64 with ReadInt")
+		t.FailNow()
+	}
+	// a failed read consumes the token
+	f, err := dec.ReadFloat64()
+	checkErrT(t, err)
+	checkEqualT(t, f, 1.5)
+	bo, err := dec.ReadBool()
+	checkErrT(t, err)
+	checkEqualT(t, bo, true)
+	s, err := dec.ReadString()
+	checkErrT(t, err)
+	checkEqualT(t, s, "abc")
+	bs, err := dec.ReadBytes()
+	checkErrT(t, err)
+	checkEqualT(t, bs, []byte{1, 2})
+	vt, err = dec.PeekType()
+	checkErrT(t, err)
+	checkEqualT(t, vt, ValueNil)
+	checkErrT(t, dec.ReadNil())
+	xtag, data, err := dec.ReadExt()
+	checkErrT(t, err)
+	checkEqualT(t, RawExt{xtag, data}, RawExt{9, []byte{7}})
+	checkErrT(t, dec.Skip())
+	s, err = dec.ReadString()
+	checkErrT(t, err)
+	checkEqualT(t, s, "last")
+	
+	// a value cut short after peeking its type is not a clean end of stream
+	dec = NewDecoder(bytes.NewReader([]byte{0x92}), nil)
+	vt, err = dec.PeekType()
+	checkErrT(t, err)
+	checkEqualT(t, vt, ValueArray)
+	var x interface{}
+	if err = dec.Decode(&x); !errors.Is(err, io.ErrUnexpectedEOF) {
+		logT(t, "------- Expecting io.ErrUnexpectedEOF. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestSkip(t *testing.T) {
+	ts := newTestStruc(1, false)
+	b, err := Marshal(&ts)
+	checkErrT(t, err)
+	
+	// all fields of the stream but I64 are unknown, and skipped
+	type subset struct {
+		I64 int64
+	}
+	var ss subset
+	checkErrT(t, Unmarshal(b, &ss, nil))
+	checkEqualT(t, ss.I64, ts.I64)
+	
+	r := bytes.NewReader(b)
+	dec := NewDecoder(r, nil)
+	checkErrT(t, dec.Skip())
+	if r.Len() != 0 {
+		logT(t, "------- Skip left %d bytes unread", r.Len())
+		t.FailNow()
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		r.Reset(b)
+		if err := dec.Skip(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	checkEqualT(t, allocs, float64(0))
+}
+
+func TestRawMessage(t *testing.T) {
+	type envelope struct {
+		Kind string
+		Payload RawMessage
+	}
+	type point struct {
+		X, Y int
+	}
+	payload, err := Marshal(point{1, 2})
+	checkErrT(t, err)
+	
+	// embed an already encoded value, within a struct, slice and map
+	msgs := []envelope{{"point", payload}, {"nothing", nil}}
+	b, err := Marshal(msgs)
+	checkErrT(t, err)
+	var v []map[string]interface{}
+	checkErrT(t, Unmarshal(b, &v, testDecOpts(mapStringIntfTyp, nil, true, true, true)))
+	checkEqualT(t, v[0]["Payload"], map[string]interface{}{"X": int8(1), "Y": int8(2)})
+	checkEqualT(t, v[1]["Payload"], nil)
+	
+	// route based on Kind, then decode Payload later.
+	var msgs2 []envelope
+	checkErrT(t, Unmarshal(b, &msgs2, nil))
+	checkEqualT(t, msgs2[0].Kind, "point")
+	checkEqualT(t, msgs2[0].Payload, RawMessage(payload))
+	var p point
+	checkErrT(t, Unmarshal(msgs2[0].Payload, &p, nil))
+	checkEqualT(t, p, point{1, 2})
+	
+	var raws []RawMessage
+	checkErrT(t, Unmarshal(b, &raws, nil))
+	checkEqualT(t, len(raws), 2)
+	var m map[string]RawMessage
+	checkErrT(t, Unmarshal(raws[0], &m, nil))
+	checkEqualT(t, m["Payload"], RawMessage(payload))
+	
+	// re-encoding the raw messages gives the same stream
+	b2, err := Marshal(raws)
+	checkErrT(t, err)
+	checkEqualT(t, b2, b)
+	
+	// a nil keeps its bytes, and is passed to Unmarshalers (but pointers are set to nil)
+	checkEqualT(t, msgs2[1].Payload, RawMessage{0xc0})
+	var nils struct {
+		R RawMessage
+		P *RawMessage
+		N testMarshalNil
+		NP *testMarshalNil
+	}
+	nils.P, nils.NP = &RawMessage{1}, &testMarshalNil{}
+	b, err = Marshal(map[string]interface{}{"R": nil, "P": nil, "N": nil, "NP": nil})
+	checkErrT(t, err)
+	checkErrT(t, Unmarshal(b, &nils, nil))
+	checkEqualT(t, nils.R, RawMessage{0xc0})
+	checkEqualT(t, nils.N, testMarshalNil{true})
+	if nils.P != nil || nils.NP != nil {
+		logT(t, "------- Expecting nil pointers. Got: %v, %v", nils.P, nils.NP)
+		t.FailNow()
+	}
+}
+
+// testMarshalNil records whether UnmarshalMsgpack was passed a nil.
+type testMarshalNil struct {
+	Nil bool
+}
+
+func (x *testMarshalNil) UnmarshalMsgpack(bs []byte) error {
+	x.Nil = len(bs) == 1 && bs[0] == 0xc0
+	return nil
+}
+
+func TestDecoderLimits(t *testing.T) {
+	// Unmarshal: lengths beyond the input fail before allocating
+	for _, b := range [][]byte{
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xdf, 0xff, 0xff, 0xff, 0xff},
+		{0xdb, 0xff, 0xff, 0xff, 0xff},
+		{0xc6, 0xff, 0xff, 0xff, 0xff},
+		{0xc9, 0xff, 0xff, 0xff, 0xff, 0x01},
+	} {
+		var v interface{}
+		err := Unmarshal(b, &v, nil)
+		checkEqualT(t, errors.Is(err, io.ErrUnexpectedEOF), true)
+		var raw RawMessage
+		err = Unmarshal(b, &raw, nil)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			logT(t, "------- Expecting io.ErrUnexpectedEOF. Got: %v", err)
+			t.FailNow()
 		}
 	}
 	
+	doLimit := func(opts DecoderOptions, v interface{}, limit string) {
+		b, err := Marshal(v)
+		checkErrT(t, err)
+		var v2 interface{}
+		err = NewDecoderWithOptions(bytes.NewBuffer(b), nil, &opts).Decode(&v2)
+		var lerr *LimitError
+		if !errors.As(err, &lerr) || lerr.Limit != limit {
+			logT(t, "------- Expecting LimitError for %s. Got: %v", limit, err)
+			t.FailNow()
+		}
+		err = NewDecoderWithOptions(bytes.NewBuffer(b), nil, &opts).Skip()
+		if !errors.As(err, &lerr) && limit != "MaxDepth" {
+			logT(t, "------- Expecting LimitError for %s when skipping. Got: %v", limit, err)
+			t.FailNow()
+		}
+	}
+	opts := DefaultDecoderOptions
+	opts.MaxContainerLen = 10
+	doLimit(opts, make([]int, 11), "MaxContainerLen")
+	doLimit(opts, map[int]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9, 10: 10, 11: 11}, 
+		"MaxContainerLen")
+	opts = DefaultDecoderOptions
+	opts.MaxStringLen = 10
+	doLimit(opts, strings.Repeat("s", 11), "MaxStringLen")
+	doLimit(opts, make([]byte, 11), "MaxStringLen")
+	opts = DefaultDecoderOptions
+	opts.MaxBytes = 100
+	doLimit(opts, make([]int, 101), "MaxBytes")
+	doLimit(opts, strings.Repeat("s", 101), "MaxBytes")
+	opts = DefaultDecoderOptions
+	opts.MaxDepth = 3
+	doLimit(opts, [][][][]int{{{{1}}}}, "MaxDepth")
+	
+	// within limits
+	var v interface{}
+	checkErrT(t, NewDecoderWithOptions(bytes.NewBuffer([]byte{0x93, 1, 2, 3}), nil, &opts).Decode(&v))
+	
+	// default depth
+	b := append(bytes.Repeat([]byte{0x91}, 2000), 0x01)
+	v = nil
+	err := Unmarshal(b, &v, nil)
+	var lerr *LimitError
+	if !errors.As(err, &lerr) || lerr.Limit != "MaxDepth" {
+		logT(t, "------- Expecting LimitError for MaxDepth. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+type testDecErrItem struct {
+	Qty int8
+}
+
+type testDecErrOrder struct {
+	Items map[string]testDecErrItem
+}
+
+// TestDecodeStreamLengths checks that a length in a stream of unknown length 
+// does not cause a large allocation before the bytes arrive.
+func TestDecodeStreamLengths(t *testing.T) {
+	for _, v := range []interface{}{new(RawMessage), new([]byte), new(string), new(testLateExt)} {
+		for _, b := range [][]byte{
+			{0xc6, 0x10, 0, 0, 0},
+			{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'},
+			{0x91, 0xc9, 0x10, 0, 0, 0, 1},
+		} {
+			var ms0, ms1 runtime.MemStats
+			runtime.ReadMemStats(&ms0)
+			// no limits: only the bytes actually read are allocated
+			opts := DecoderOptions{MaxStringLen: -1, MaxContainerLen: -1}
+			err := NewDecoderWithOptions(bytes.NewReader(b), nil, &opts).Decode(v)
+			runtime.ReadMemStats(&ms1)
+			if err == nil {
+				logT(t, "------- Expecting error decoding % x into %T", b, v)
+				t.FailNow()
+			}
+			if n := ms1.TotalAlloc - ms0.TotalAlloc; n > 1 << 20 {
+				logT(t, "------- Decoding % x into %T allocated %d bytes", b, v, n)
+				t.FailNow()
+			}
+		}
+	}
+	
+	// lists into typed slices (or interface{}) are also grown as elements arrive
+	nested := bytes.Repeat([]byte{0xdd, 0, 0x0f, 0xff, 0xff}, 100)
+	for _, x := range []struct{
+		v interface{}
+		b []byte
+	}{
+		{new([][256]byte), []byte{0xdd, 0, 0x10, 0, 0}},
+		{new([][4096]byte), []byte{0xdd, 0, 0x10, 0, 0, 0x90}},
+		{&[][4096]byte{{1}}, []byte{0xdd, 0, 0x10, 0, 0}},
+		{new(interface{}), []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{new(interface{}), []byte{0xc6, 0x10, 0, 0, 0}},
+		{new(interface{}), []byte{0x91, 0xc6, 0x10, 0, 0, 0}},
+		{new(map[string]interface{}), []byte{0x81, 0xa1, 'a', 0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{new(interface{}), nested},
+	} {
+		var ms0, ms1 runtime.MemStats
+		runtime.ReadMemStats(&ms0)
+		opts := DecoderOptions{MaxStringLen: -1, MaxContainerLen: -1}
+		err := NewDecoderWithOptions(bytes.NewReader(x.b), nil, &opts).Decode(x.v)
+		runtime.ReadMemStats(&ms1)
+		if err == nil {
+			logT(t, "------- Expecting error decoding % x into %T", x.b, x.v)
+			t.FailNow()
+		}
+		if n := ms1.TotalAlloc - ms0.TotalAlloc; n > 1 << 20 {
+			logT(t, "------- Decoding % x into %T allocated %d bytes", x.b, x.v, n)
+			t.FailNow()
+		}
+	}
+	
+	// which still decodes them
+	xs := make([][300]byte, 1000)
+	xs[999][299] = 1
+	b, err := Marshal(xs)
+	checkErrT(t, err)
+	var xs2 [][300]byte
+	checkErrT(t, NewDecoder(bytes.NewReader(b), nil).Decode(&xs2))
+	checkEqualT(t, xs2, xs)
+	var v interface{}
+	checkErrT(t, NewDecoder(bytes.NewReader(b), nil).Decode(&v))
+	checkEqualT(t, len(v.([]interface{})), 1000)
+
+}
+
+func TestDecodeStreamDefaultLimits(t *testing.T) {
+	var lerr *LimitError
+	for _, b := range [][]byte{
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xdf, 0x00, 0x10, 0x00, 0x01},
+		{0xc6, 0x10, 0, 0, 0},
+	} {
+		var v interface{}
+		err := NewDecoder(bytes.NewReader(b), nil).Decode(&v)
+		if !errors.As(err, &lerr) {
+			logT(t, "------- Expecting LimitError decoding % x from a stream. Got: %v", b, err)
+			t.FailNow()
+		}
+		// bytes input is limited by its length instead
+		err = Unmarshal(b, &v, nil)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			logT(t, "------- Expecting io.ErrUnexpectedEOF unmarshalling % x. Got: %v", b, err)
+			t.FailNow()
+		}
+	}
+
+	// the rpc codecs take DecoderOptions
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	sc := NewCustomRPCServerCodecWithOptions(c2, nil, &DecoderOptions{MaxStringLen: 4})
+	defer sc.Close()
+	go c1.Write([]byte{0x94, 0, 1, 0xa5, 'A', '.', 'a', 'd', 'd', 0x90})
+	var req rpc.Request
+	if err := sc.ReadRequestHeader(&req); !errors.As(err, &lerr) {
+		logT(t, "------- Expecting LimitError from rpc codec. Got: %v", err)
+		t.FailNow()
+	}
+	checkEqualT(t, lerr.Limit, "MaxStringLen")
+}
+
+func TestDecodeError(t *testing.T) {
+	// Qty 300 does not fit into an int8
+	type item struct { Qty int }
+	type order struct { Items map[string]item }
+	orders := make([]order, 4)
+	orders[3].Items = map[string]item{"sku": {300}}
+	b, err := Marshal(map[string]interface{}{"Orders": orders})
+	checkErrT(t, err)
+	var v struct { Orders []testDecErrOrder }
+	err = Unmarshal(b, &v, nil)
+	var derr *DecodeError
+	var terr *UnmarshalTypeError
+	if !errors.As(err, &derr) || !errors.As(err, &terr) {
+		logT(t, "------- Expecting DecodeError and UnmarshalTypeError. Got: %v", err)
+		t.FailNow()
+	}
+	checkEqualT(t, derr.Path, `Orders[3].Items["sku"].Qty`)
+	checkEqualT(t, derr.Desc, byte(0xd1))
+	checkEqualT(t, b[derr.Offset], byte(0xd1))
+	checkEqualT(t, terr.Value, "Int 300")
+	checkEqualT(t, terr.Type, reflect.TypeOf(int8(0)))
+	logT(t, "DecodeError: %v", err)
+
+	// str into an int
+	var ints []int
+	err = Unmarshal([]byte{0x92, 0x01, 0xa1, 'x'}, &ints, nil)
+	if !errors.As(err, &terr) || terr.Value != "Str" || terr.Offset != 2 {
+		logT(t, "------- Expecting UnmarshalTypeError for Str. Got: %v", err)
+		t.FailNow()
+	}
+	
+	// invalid descriptor
+	var serr *SyntaxError
+	err = Unmarshal([]byte{0x92, 0x01, 0xc1}, &ints, nil)
+	if !errors.As(err, &serr) || serr.Desc != 0xc1 || serr.Offset != 2 {
+		logT(t, "------- Expecting SyntaxError. Got: %v", err)
+		t.FailNow()
+	}
+	errors.As(err, &derr)
+	checkEqualT(t, derr.Path, "[1]")
+
+	// io.EOF AS IS at the start of a value, else io.ErrUnexpectedEOF
+	dec := NewDecoder(bytes.NewBuffer([]byte{0x01, 0x92, 0x01}), nil)
+	var i int
+	checkErrT(t, dec.Decode(&i))
+	err = dec.Decode(&ints)
+	if err == io.EOF || !errors.Is(err, io.ErrUnexpectedEOF) {
+		logT(t, "------- Expecting io.ErrUnexpectedEOF. Got: %v", err)
+		t.FailNow()
+	}
+	checkEqualT(t, NewDecoder(bytes.NewBuffer(nil), nil).Decode(&i), io.EOF)
+}
+
+type testStrictStruc struct {
+	Name string `msgpack:"name,required"`
+	Qty int
+}
+
+func TestDecodeStrict(t *testing.T) {
+	b, err := Marshal(map[string]interface{}{"name": "n1", "Qty": 3, "Extra": true})
+	checkErrT(t, err)
+	var v testStrictStruc
+	checkErrT(t, Unmarshal(b, &v, nil))
+	checkEqualT(t, v, testStrictStruc{"n1", 3})
+	
+	opts := DefaultDecoderOptions
+	opts.DisallowUnknownFields = true
+	var v2 []testStrictStruc
+	b, err = Marshal([]interface{}{map[string]interface{}{"name": "n1", "Extra": true}})
+	checkErrT(t, err)
+	err = NewDecoderWithOptions(bytes.NewBuffer(b), nil, &opts).Decode(&v2)
+	var uerr *UnknownFieldError
+	if !errors.As(err, &uerr) || uerr.Field != "Extra" || uerr.Type != reflect.TypeOf(v) {
+		logT(t, "------- Expecting UnknownFieldError. Got: %v", err)
+		t.FailNow()
+	}
+	logT(t, "UnknownFieldError: %v", err)
+	
+	// required field absent
+	for _, m := range []map[string]interface{}{{"Qty": 3}, {}} {
+		b, err = Marshal([]interface{}{m})
+		checkErrT(t, err)
+		err = Unmarshal(b, &v2, nil)
+		var merr *MissingFieldError
+		var derr *DecodeError
+		if !errors.As(err, &merr) || merr.Field != "name" || !errors.As(err, &derr) || derr.Path != "[0]" {
+			logT(t, "------- Expecting MissingFieldError. Got: %v", err)
+			t.FailNow()
+		}
+	}
+}
+
+type testArrayStruc struct {
+	_struct bool `msgpack:",toarray"`
+	A string
+	B int
+	C []int
+}
+
+type testPlainStruc struct {
+	A string
+	B int
+	C []int
+}
+
+func TestStructToArray(t *testing.T) {
+	v := testArrayStruc{A: "a", B: 2}
+	b, err := Marshal(v)
+	checkErrT(t, err)
+	b2, err := Marshal([]interface{}{"a", 2, nil})
+	checkErrT(t, err)
+	checkEqualT(t, b, b2)
+	var v2 testArrayStruc
+	checkErrT(t, Unmarshal(b, &v2, nil))
+	checkEqualT(t, v2, v)
+	// an array decodes into a struct without toarray, and a map into one with it
+	var p testPlainStruc
+	checkErrT(t, Unmarshal(b, &p, nil))
+	checkEqualT(t, p, testPlainStruc{"a", 2, nil})
+	b, err = Marshal(testPlainStruc{"x", 3, []int{4}})
+	checkErrT(t, err)
+	v2 = testArrayStruc{}
+	checkErrT(t, Unmarshal(b, &v2, nil))
+	checkEqualT(t, v2, testArrayStruc{A: "x", B: 3, C: []int{4}})
+	
+	// Encoder-wide option
+	eopts := DefaultEncoderOptions
+	eopts.StructToArray = true
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderWithOptions(&buf, &eopts).Encode([]testPlainStruc{{"y", 5, nil}}))
+	b2, err = Marshal([]interface{}{[]interface{}{"y", 5, nil}})
+	checkErrT(t, err)
+	checkEqualT(t, buf.Bytes(), b2)
+	
+	// extra elements are skipped (or rejected if DisallowUnknownFields)
+	b, err = Marshal([]interface{}{"z", 6, []int{7}, "extra"})
+	checkErrT(t, err)
+	p = testPlainStruc{}
+	checkErrT(t, Unmarshal(b, &p, nil))
+	checkEqualT(t, p, testPlainStruc{"z", 6, []int{7}})
+	dopts := DefaultDecoderOptions
+	dopts.DisallowUnknownFields = true
+	err = NewDecoderWithOptions(bytes.NewBuffer(b), nil, &dopts).Decode(&p)
+	var uerr *UnknownFieldError
+	if !errors.As(err, &uerr) || uerr.Field != "[3]" {
+		logT(t, "------- Expecting UnknownFieldError. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+type testIntKeyStruc struct {
+	A int64 `msgpack:"1"`
+	B string `msgpack:"2,omitempty"`
+	C string
+	D string `msgpack:"01,omitempty"`
+	E string `msgpack:"+3,omitempty"`
+}
+
+func TestStructIntKeys(t *testing.T) {
+	v := testIntKeyStruc{A: 10, C: "c"}
+	b, err := Marshal(v)
+	checkErrT(t, err)
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.WriteMapHeader(2)
+	enc.WriteInt(1)
+	enc.WriteInt(10)
+	enc.WriteString("C")
+	enc.WriteString("c")
+	checkEqualT(t, b, buf.Bytes())
+	var v2 testIntKeyStruc
+	checkErrT(t, Unmarshal(b, &v2, nil))
+	checkEqualT(t, v2, v)
+	
+	// unknown integer keys are skipped (or rejected if DisallowUnknownFields)
+	b, err = Marshal(map[interface{}]interface{}{2: "b", 9: true})
+	checkErrT(t, err)
+	v2 = testIntKeyStruc{}
+	checkErrT(t, Unmarshal(b, &v2, nil))
+	checkEqualT(t, v2, testIntKeyStruc{B: "b"})
+	dopts := DefaultDecoderOptions
+	dopts.DisallowUnknownFields = true
+	err = NewDecoderWithOptions(bytes.NewBuffer(b), nil, &dopts).Decode(&v2)
+	var uerr *UnknownFieldError
+	if !errors.As(err, &uerr) || uerr.Field != "9" {
+		logT(t, "------- Expecting UnknownFieldError. Got: %v", err)
+		t.FailNow()
+	}
+	
+	// a uint64 key too big for an int64 is unknown too
+	b = []byte{0x82, 0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xc3, 0xcf, 0, 0, 0, 0, 0, 0, 0, 1, 5}
+	v2 = testIntKeyStruc{}
+	checkErrT(t, Unmarshal(b, &v2, nil))
+	checkEqualT(t, v2, testIntKeyStruc{A: 5})
+	err = NewDecoderWithOptions(bytes.NewBuffer(b), nil, &dopts).Decode(&v2)
+	if !errors.As(err, &uerr) || uerr.Field != "18446744073709551615" {
+		logT(t, "------- Expecting UnknownFieldError. Got: %v", err)
+		t.FailNow()
+	}
+	
+	// only canonical decimal names are integer keys
+	b, err = Marshal(testIntKeyStruc{C: "c", D: "d", E: "e"})
+	checkErrT(t, err)
+	var m map[interface{}]interface{}
+	checkErrT(t, Unmarshal(b, &m, testDecOpts(nil, nil, true, true, true)))
+	checkEqualT(t, len(m), 4)
+	checkEqualT(t, m["01"], "d")
+	checkEqualT(t, m["+3"], "e")
+	v2 = testIntKeyStruc{}
+	checkErrT(t, Unmarshal(b, &v2, nil))
+	checkEqualT(t, v2, testIntKeyStruc{C: "c", D: "d", E: "e"})
+}
+
+func TestCanonical(t *testing.T) {
+	opts := DefaultEncoderOptions
+	opts.Canonical = true
+	enc := func(v interface{}) []byte {
+		var buf bytes.Buffer
+		checkErrT(t, NewEncoderWithOptions(&buf, &opts).Encode(v))
+		return buf.Bytes()
+	}
+	m := make(map[interface{}]interface{})
+	for j := 0; j < 50; j++ {
+		m[j] = strconv.Itoa(j)
+		m[strconv.Itoa(j)] = int64(j)
+	}
+	m2 := map[string]interface{}{"m": m, "b": true, "aa": 1, "a": 2}
+	b := enc(m2)
+	for j := 0; j < 10; j++ {
+		checkEqualT(t, enc(m2), b)
+	}
+	// keys ordered by encoded bytes (shorter strs first)
+	checkEqualT(t, enc(map[string]int{"b": 1, "aa": 2, "a": 3}), 
+		[]byte{0x83, 0xa1, 'a', 3, 0xa1, 'b', 1, 0xa2, 'a', 'a', 2})
+	var v interface{}
+	checkErrT(t, Unmarshal(b, &v, nil))
+	
+	// smallest integers whatever the type, and a single NaN
+	checkEqualT(t, enc(int64(200)), enc(uint8(200)))
+	checkEqualT(t, enc(int16(200)), []byte{0xcc, 200})
+	checkEqualT(t, enc(math.Float64frombits(0x7ff8000000000001)), enc(math.NaN()))
+	checkEqualT(t, enc(float32(math.Float32frombits(0x7fc00001))), []byte{0xca, 0x7f, 0xc0, 0, 0})
+	checkEqualT(t, enc(math.Copysign(0, -1)), enc(float64(0)))
+	checkEqualT(t, enc(float32(math.Copysign(0, -1))), []byte{0xca, 0, 0, 0, 0})
+	
+	// maps within maps (the keys of each are sorted in the same scratch buffer)
+	m3 := make(map[string]map[string]int)
+	for j := 0; j < 20; j++ {
+		m3[strconv.Itoa(j)] = map[string]int{strconv.Itoa(j + 1): j, "x": -j}
+	}
+	b = enc(m3)
+	checkEqualT(t, enc(m3), b)
+	var m4 map[string]map[string]int
+	checkErrT(t, Unmarshal(b, &m4, nil))
+	checkEqualT(t, m4, m3)
+}
+
+// TestStructInfoCacheParallel encodes and decodes many distinct struct types in parallel.
+// Run with -race.
+func TestStructInfoCacheParallel(t *testing.T) {
+	const numTypes, numGoroutines = 64, 8
+	rts := make([]reflect.Type, numTypes)
+	for j := range rts {
+		rts[j] = reflect.StructOf([]reflect.StructField{
+			{Name: fmt.Sprintf("A%d", j), Type: reflect.TypeOf(0)},
+			{Name: "S", Type: reflect.TypeOf(""), Tag: reflect.StructTag(fmt.Sprintf(`msgpack:"s%d"`, j))},
+		})
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, numGoroutines)
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for k := 0; k < numTypes; k++ {
+				rt := rts[(k + g * 7) % numTypes]
+				rv := reflect.New(rt).Elem()
+				rv.Field(0).SetInt(int64(k))
+				rv.Field(1).SetString(rt.Field(0).Name)
+				b, err := Marshal(rv.Interface())
+				if err != nil {
+					errs <- err
+					return
+				}
+				rv2 := reflect.New(rt)
+				if err = Unmarshal(b, rv2.Interface(), nil); err != nil {
+					errs <- err
+					return
+				}
+				if !reflect.DeepEqual(rv2.Elem().Interface(), rv.Interface()) {
+					errs <- fmt.Errorf("Do not match: %v, %v", rv2.Elem().Interface(), rv.Interface())
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		checkErrT(t, err)
+	}
+}
+
+type testRecursive struct {
+	Name string
+	Kids []testRecursive
+	Next *testRecursive
+}
+
+type testLateExt struct {
+	A uint8
+}
+
+// testEmbedPtr embeds a pointer to an (exported) struct, which is not supported.
+type testEmbedPtr struct {
+	*TestEmbedPtrElem
+}
+
+type TestEmbedPtrElem struct {
+	X int
+}
+
+// TestTypeFns checks the encode/decode funcs built and cached for each type.
+func TestTypeFns(t *testing.T) {
+	v := testRecursive{"a", []testRecursive{{Name: "b"}}, &testRecursive{Name: "c"}}
+	b, err := Marshal(v)
+	checkErrT(t, err)
+	var v2 testRecursive
+	checkErrT(t, Unmarshal(b, &v2, nil))
+	checkEqualT(t, v2, v)
+	
+	// registering an extension for a type already encoded/decoded applies to it
+	x := testLateExt{7}
+	b, err = Marshal(x)
+	checkErrT(t, err)
+	checkEqualT(t, b, []byte{0x81, 0xa1, 'A', 7})
+	var x2 testLateExt
+	checkErrT(t, Unmarshal(b, &x2, nil))
+	err = RegisterExt(6, reflect.TypeOf(x),
+		func(rv reflect.Value) ([]byte, error) {
+			return []byte{byte(rv.Field(0).Uint())}, nil
+		},
+		func(rv reflect.Value, data []byte) error {
+			rv.Field(0).SetUint(uint64(data[0]))
+			return nil
+		})
+	checkErrT(t, err)
+	b, err = Marshal(x)
+	checkErrT(t, err)
+	checkEqualT(t, b, []byte{0xd4, 6, 7})
+	x2 = testLateExt{}
+	checkErrT(t, Unmarshal(b, &x2, nil))
+	checkEqualT(t, x2, x)
+	
+	// a type which fails to build fails each time it is encoded
+	done := make(chan error, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			_, err := Marshal(testEmbedPtr{&TestEmbedPtrElem{1}})
+			done <- err
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err = <-done:
+			if err == nil {
+				logT(t, "------- Expecting error encoding %T", testEmbedPtr{})
+				t.FailNow()
+			}
+		case <-time.After(5 * time.Second):
+			logT(t, "------- Encoding %T (attempt %d) blocked", testEmbedPtr{}, i + 1)
+			t.FailNow()
+		}
+	}
+	
+	// a func built while RegisterExt runs is not cached
+	rt := reflect.TypeOf(struct{ B int }{})
+	version := atomic.LoadUint64(&fnsVersion)
+	atomic.AddUint64(&fnsVersion, 1)
+	storeFn(&decFns, rt, buildDecFn(rt), version)
+	if _, ok := decFns.Load(rt); ok {
+		logT(t, "------- Expecting no cached decFn for %v", rt)
+		t.FailNow()
+	}
+}
+
+type testOmitEmpty struct {
+	A string `msgpack:",omitempty"`
+	B []testOmitEmpty `msgpack:",omitempty"`
+	C int `msgpack:",omitempty"`
+}
+
+// TestStructOmitEmpty checks nested omitempty structs, and that encoding 
+// structs does not allocate.
+func TestStructOmitEmpty(t *testing.T) {
+	v := testOmitEmpty{B: []testOmitEmpty{{A: "a"}, {C: 1, B: []testOmitEmpty{{}}}}, C: 2}
+	b, err := Marshal(v)
+	checkErrT(t, err)
+	checkEqualT(t, b, []byte{0x82, 0xa1, 'B', 0x92, 0x81, 0xa1, 'A', 0xa1, 'a', 
+		0x82, 0xa1, 'B', 0x91, 0x80, 0xa1, 'C', 1, 0xa1, 'C', 2})
+	var v2 testOmitEmpty
+	checkErrT(t, Unmarshal(b, &v2, nil))
+	checkEqualT(t, v2, v)
+	
+	enc := NewEncoder(ioutil.Discard)
+	for _, x := range []interface{}{&v, &testIntKeyStruc{A: 1, B: "b", C: "c"}} {
+		if n := testing.AllocsPerRun(100, func() { checkErrT(t, enc.Encode(x)) }); n != 0 {
+			t.Errorf("Encode %T: %v allocs, expected 0", x, n)
+		}
+	}
+}
+
+// testCountWriter counts the calls to Write.
+type testCountWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *testCountWriter) Write(p []byte) (int, error) {
+	w.n++
+	return w.Buffer.Write(p)
+}
+
+func TestBufferedEncoder(t *testing.T) {
+	v := testOmitEmpty{A: strings.Repeat("a", 100), B: []testOmitEmpty{{A: "a"}, {C: 1}}, C: 2}
+	b, err := Marshal(v)
+	checkErrT(t, err)
+	var w testCountWriter
+	enc := NewBufferedEncoder(&w, nil)
+	checkErrT(t, enc.Encode(v))
+	checkEqualT(t, w.n, 1)
+	checkEqualT(t, w.Bytes(), b)
+	
+	// Write methods are buffered till Flush (or the next Encode)
+	w.Reset()
+	w.n = 0
+	checkErrT(t, enc.WriteArrayHeader(2))
+	checkErrT(t, enc.WriteString("a"))
+	checkEqualT(t, w.n, 0)
+	checkErrT(t, enc.Encode(1))
+	checkEqualT(t, w.n, 1)
+	checkErrT(t, enc.WriteNil())
+	checkErrT(t, enc.Flush())
+	checkEqualT(t, w.n, 2)
+	checkEqualT(t, w.Bytes(), []byte{0x92, 0xa1, 'a', 1, 0xc0})
+	
+	// a value which fails to encode is not written
+	w.Reset()
+	if err = enc.Encode([]interface{}{1, make(chan int)}); err == nil {
+		logT(t, "------- Expecting error encoding a chan")
+		t.FailNow()
+	}
+	checkErrT(t, enc.Flush())
+	checkEqualT(t, w.Len(), 0)
+	
+	// values bigger than the buffer are written in pieces
+	w.n = 0
+	w.Reset()
+	big := make([]string, 2 * encFlushSize / 1000)
+	for i := range big {
+		big[i] = strings.Repeat("x", 1000)
+	}
+	b, err = Marshal(big)
+	checkErrT(t, err)
+	checkErrT(t, enc.Encode(big))
+	if w.n < 2 || !bytes.Equal(w.Bytes(), b) {
+		logT(t, "------- Unexpected writes: %v, len: %v", w.n, w.Len())
+		t.FailNow()
+	}
+	
+	// tokens buffered before a value which fails to encode are kept
+	w.Reset()
+	checkErrT(t, enc.WriteArrayHeader(1))
+	if err = enc.Encode(make(chan int)); err == nil {
+		logT(t, "------- Expecting error encoding a chan")
+		t.FailNow()
+	}
+	checkErrT(t, enc.Encode(1))
+	checkEqualT(t, w.Bytes(), []byte{0x91, 1})
+	
+	// unless it holds values (as the rpc codecs do), nothing is written 
+	// of a big value which fails to encode
+	w.Reset()
+	enc.holdValues = true
+	if err = enc.Encode([]interface{}{big, make(chan int)}); err == nil {
+		logT(t, "------- Expecting error encoding a chan")
+		t.FailNow()
+	}
+	checkEqualT(t, w.Len(), 0)
+	w.n = 0
+	checkErrT(t, enc.Encode(big))
+	checkEqualT(t, w.n, 1)
+	checkEqualT(t, w.Bytes(), b)
+}
+
+func TestEncoderBytes(t *testing.T) {
+	v := testOmitEmpty{A: "a", B: []testOmitEmpty{{A: "b"}, {C: 1}}, C: 2}
+	b, err := Marshal(v)
+	checkErrT(t, err)
+	
+	b2, err := MarshalAppend([]byte("prefix"), v)
+	checkErrT(t, err)
+	checkEqualT(t, b2, append([]byte("prefix"), b...))
+	// on error, dst is returned as is
+	b3, err := MarshalAppend(b2[:6], []interface{}{1, make(chan int)})
+	if err == nil {
+		logT(t, "------- Expecting error encoding a chan")
+		t.FailNow()
+	}
+	checkEqualT(t, b3, []byte("prefix"))
+	
+	enc := NewEncoderBytes(nil, nil)
+	checkErrT(t, enc.Encode(v))
+	checkErrT(t, enc.WriteNil())
+	checkEqualT(t, enc.Bytes(), append(b, 0xc0))
+	// a value which fails to encode is not appended
+	if err = enc.Encode([]interface{}{1, make(chan int)}); err == nil {
+		logT(t, "------- Expecting error encoding a chan")
+		t.FailNow()
+	}
+	checkEqualT(t, enc.Bytes(), append(b, 0xc0))
+	checkErrT(t, enc.Flush())
+	
+	// the Encoder and its buffer can be reused without allocating
+	if n := testing.AllocsPerRun(100, func() { 
+		enc.ResetBytes(enc.Bytes()[:0])
+		checkErrT(t, enc.Encode(&v))
+	}); n != 0 {
+		t.Errorf("Encode: %v allocs, expected 0", n)
+	}
+	checkEqualT(t, enc.Bytes(), b)
+	b2, err = MarshalAppend(b2[:0], &v)
+	checkErrT(t, err)
+	checkEqualT(t, b2, b)
+}
+
+func TestReset(t *testing.T) {
+	v := testOmitEmpty{A: "a", B: []testOmitEmpty{{A: "b"}, {C: 1}}, C: 2}
+	b, err := Marshal(v)
+	checkErrT(t, err)
+	
+	// buffered output not flushed is discarded
+	var w1, w2 bytes.Buffer
+	enc := NewBufferedEncoder(&w1, nil)
+	checkErrT(t, enc.WriteArrayHeader(1))
+	enc.Reset(&w2)
+	checkErrT(t, enc.Encode(v))
+	checkEqualT(t, w1.Len(), 0)
+	checkEqualT(t, w2.Bytes(), b)
+	// an Encoder from NewEncoderBytes does not reuse the caller's buffer
+	enc = NewEncoderBytes(nil, nil)
+	checkErrT(t, enc.Encode(v))
+	b2 := enc.Bytes()
+	w2.Reset()
+	enc.Reset(&w2)
+	checkErrT(t, enc.Encode(1))
+	checkEqualT(t, b2, b)
+	checkEqualT(t, w2.Bytes(), []byte{1})
+	
+	// offsets in errors are counted from the Reset
+	dec := NewDecoder(bytes.NewReader(b), nil)
+	var v2 testOmitEmpty
+	checkErrT(t, dec.Decode(&v2))
+	checkEqualT(t, v2, v)
+	for _, reset := range []func(){
+		func() { dec.Reset(bytes.NewReader(b)) },
+		func() { dec.ResetBytes(b) },
+	} {
+		reset()
+		var x int
+		var derr *DecodeError
+		if err = dec.Decode(&x); !errors.As(err, &derr) || derr.Offset != 0 {
+			logT(t, "------- Expecting DecodeError at offset 0. Got: %v", err)
+			t.FailNow()
+		}
+		reset()
+		v2 = testOmitEmpty{}
+		checkErrT(t, dec.Decode(&v2))
+		checkEqualT(t, v2, v)
+	}
+	
+	// Marshal and Unmarshal reuse pooled Encoders and Decoders, so they allocate 
+	// nothing, apart from a new Encoder or Decoder when the sync.Pool drops one 
+	// (as it often does under the race detector). So allow up to 1 alloc per run.
+	var b3 []byte
+	if n := testing.AllocsPerRun(100, func() { 
+		b3, err = MarshalAppend(b3[:0], &v)
+	}); n > 1 {
+		t.Errorf("MarshalAppend: %v allocs, expected at most 1", n)
+	}
+	checkEqualT(t, b3, b)
+	xs := make([]int64, 3)
+	b, err = Marshal(xs)
+	checkErrT(t, err)
+	if n := testing.AllocsPerRun(100, func() { 
+		checkErrT(t, Unmarshal(b, &xs, nil))
+	}); n > 1 {
+		t.Errorf("Unmarshal: %v allocs, expected at most 1", n)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				x := testOmitEmpty{A: strconv.Itoa(i), C: j}
+				bs, err := Marshal(x)
+				checkErrT(t, err)
+				var x2 testOmitEmpty
+				checkErrT(t, Unmarshal(bs, &x2, nil))
+				checkEqualT(t, x2, x)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+type testAliasStruc struct {
+	B []byte
+	R RawMessage
+	S string
+}
+
+func TestDecoderBytes(t *testing.T) {
+	// decoding from a []byte and from an io.Reader give the same values
+	dam := testDecOpts(nil, nil, false, true, true)
+	for i, v0 := range table {
+		b, err := Marshal(v0)
+		checkErrT(t, err)
+		rt := intfTyp
+		if v0 != nil {
+			rt = reflect.TypeOf(v0)
+		}
+		v1, v2 := reflect.New(rt), reflect.New(rt)
+		checkErrT(t, NewDecoder(bytes.NewReader(b), dam).DecodeValue(v1))
+		checkErrT(t, NewDecoderBytes(b, dam).DecodeValue(v2))
+		if !reflect.DeepEqual(v1.Interface(), v2.Interface()) {
+			logT(t, "------- #%d: Decoded from []byte: %#v, from io.Reader: %#v", i, v2, v1)
+			t.FailNow()
+		}
+	}
+	
+	// multiple values, then io.EOF at the end, or io.ErrUnexpectedEOF in a value
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	checkErrT(t, enc.Encode("abc"))
+	checkErrT(t, enc.Encode(testAliasStruc{[]byte("bytes"), RawMessage{0x92, 1, 2}, "s"}))
+	b := buf.Bytes()
+	dec := NewDecoderBytes(b, nil)
+	var s string
+	checkErrT(t, dec.Decode(&s))
+	checkEqualT(t, s, "abc")
+	var v testAliasStruc
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, dec.Decode(&s), io.EOF)
+	dec = NewDecoderBytes(b[:len(b) - 1], nil)
+	checkErrT(t, dec.Skip())
+	if err := dec.Decode(&v); !errors.Is(err, io.ErrUnexpectedEOF) {
+		logT(t, "------- Expecting io.ErrUnexpectedEOF. Got: %v", err)
+		t.FailNow()
+	}
+	
+	// []byte and RawMessage values refer to the input only with AliasInput
+	inInput := func(bs []byte) bool {
+		return &bs[0] == &b[bytes.Index(b, bs)]
+	}
+	dec = NewDecoderBytes(b, nil)
+	checkErrT(t, dec.Skip())
+	v = testAliasStruc{}
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, v, testAliasStruc{[]byte("bytes"), RawMessage{0x92, 1, 2}, "s"})
+	checkEqualT(t, inInput(v.B) || inInput(v.R), false)
+	opts := DefaultDecoderOptions
+	opts.AliasInput = true
+	dec = NewDecoderBytesWithOptions(b, nil, &opts)
+	checkErrT(t, dec.Skip())
+	v = testAliasStruc{}
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, v, testAliasStruc{[]byte("bytes"), RawMessage{0x92, 1, 2}, "s"})
+	checkEqualT(t, inInput(v.B) && inInput(v.R), true)
+	// appending to an aliased value does not overwrite the input
+	checkEqualT(t, cap(v.B), len(v.B))
+	_, err := dec.ReadBytes()
+	checkEqualT(t, err, io.EOF)
+	dec = NewDecoderBytesWithOptions(b[bytes.Index(b, []byte("bytes")) - 2:], nil, &opts)
+	bs, err := dec.ReadBytes()
+	checkErrT(t, err)
+	checkEqualT(t, inInput(bs), true)
 }
 
 func testDecOpts(MapType reflect.Type, SliceType reflect.Type, BytesStringLiteral bool,
@@ -37,20 +37,52 @@ An RPC Client and Server Codec is implemented, so that msgpack can be used
 with the standard net/rpc package. It supports both a basic net/rpc serialization,
 and the custom format defined at http://wiki.msgpack.org/display/MSGPACK/RPC+specification
 
+The custom format also supports msgpack-rpc notifications (see CustomRPCCodec).
+
 */
 package msgpack
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strings"
+	"sync"
 	"net/rpc"
 	"io"
 )
 
+// CustomRPCCodec is implemented by the codecs returned by NewCustomRPCClientCodec 
+// and NewCustomRPCServerCodec, for msgpack-rpc notifications: messages 
+// [2, method, params] which get no response.
+// 
+// A server codec dispatches the notifications it receives to the rpc.Server, 
+// like requests (with the first param as the argument), but writes no response.
+// A client codec passes them to the function set by OnNotify, or skips them.
+// 
+// Sample Usage:
+//   codec := msgpack.NewCustomRPCClientCodec(conn, nil)
+//   client := rpc.NewClientWithCodec(codec)
+//   err = codec.(msgpack.CustomRPCCodec).Notify("Arith.Log", "some message")
+type CustomRPCCodec interface {
+	// Notify sends the notification [2, method, params]. 
+	// It is safe to call concurrently with the rpc.Client or rpc.Server using the codec.
+	Notify(method string, params ...interface{}) error
+	// OnNotify sets the function called (by the goroutine reading responses) 
+	// with each notification received by a client codec. 
+	// It may be called at any time.
+	OnNotify(fn func(method string, params RawMessage))
+}
+
+// rpcNotifySeq is the Seq of an rpc.Request read from a notification. 
+// It is outside the range of msgpack-rpc msgids (uint32), so WriteResponse can tell. 
+const rpcNotifySeq = math.MaxUint64
+
 type rpcCodec struct {
 	rwc       io.ReadWriteCloser
 	dec       *Decoder
 	enc       *Encoder
+	wmu       sync.Mutex // serializes writes, as Notify may be called at any time
 }
 
 type basicRpcCodec struct {
@@ -59,13 +91,18 @@ type basicRpcCodec struct {
 
 type customRpcCodec struct {
 	rpcCodec
+	nmu sync.Mutex // guards onNotify, which is set while responses are read
+	onNotify func(method string, params RawMessage)
 }
 
-func newRPCCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpcCodec) {
+func newRPCCodec(conn io.ReadWriteCloser, dam DecoderContainerResolver, opts *DecoderOptions) (rpcCodec) {
+	enc := NewBufferedEncoder(conn, nil)
+	// buffer whole messages, so one which fails to encode is never partly written
+	enc.holdValues = true
 	return rpcCodec{
 		rwc: conn,
-		dec: NewDecoder(conn, opts),
-		enc: NewEncoder(conn),
+		dec: NewDecoderWithOptions(conn, dam, opts),
+		enc: enc,
 	}
 }
 
@@ -77,34 +114,62 @@ func newRPCCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpcCod
 //   client := rpc.NewClientWithCodec(codec)
 //   ... (see rpc package for how to use an rpc client)
 func NewRPCClientCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ClientCodec) {
-	return &basicRpcCodec{ newRPCCodec(conn, opts) }
+	return NewRPCClientCodecWithOptions(conn, opts, nil)
+}
+
+// NewRPCClientCodecWithOptions is like NewRPCClientCodec, but decodes with the given 
+// DecoderOptions (e.g. to set limits on what a peer may send). 
+// A nil opts means DefaultDecoderOptions.
+func NewRPCClientCodecWithOptions(conn io.ReadWriteCloser, dam DecoderContainerResolver, opts *DecoderOptions) (rpc.ClientCodec) {
+	return &basicRpcCodec{ newRPCCodec(conn, dam, opts) }
 }
 
 // NewRPCServerCodec uses basic msgpack serialization for rpc communication from the server side.
 func NewRPCServerCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ServerCodec) {
-	return &basicRpcCodec{ newRPCCodec(conn, opts) }
+	return NewRPCServerCodecWithOptions(conn, opts, nil)
+}
+
+// NewRPCServerCodecWithOptions is like NewRPCServerCodec, but decodes with the given DecoderOptions.
+func NewRPCServerCodecWithOptions(conn io.ReadWriteCloser, dam DecoderContainerResolver, opts *DecoderOptions) (rpc.ServerCodec) {
+	return &basicRpcCodec{ newRPCCodec(conn, dam, opts) }
 }
 
 // NewCustomRPCClientCodec uses msgpack serialization for rpc communication from client side, 
 // but uses a custom protocol defined at http://wiki.msgpack.org/display/MSGPACK/RPC+specification
 func NewCustomRPCClientCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ClientCodec) {
-	return &customRpcCodec{ newRPCCodec(conn, opts) }
+	return NewCustomRPCClientCodecWithOptions(conn, opts, nil)
+}
+
+// NewCustomRPCClientCodecWithOptions is like NewCustomRPCClientCodec, but decodes with the given DecoderOptions.
+func NewCustomRPCClientCodecWithOptions(conn io.ReadWriteCloser, dam DecoderContainerResolver, opts *DecoderOptions) (rpc.ClientCodec) {
+	return &customRpcCodec{ rpcCodec: newRPCCodec(conn, dam, opts) }
 }
 	
 // NewCustomRPCServerCodec uses msgpack serialization for rpc communication from server side, 
 // but uses a custom protocol defined at http://wiki.msgpack.org/display/MSGPACK/RPC+specification
 func NewCustomRPCServerCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ServerCodec) {
-	return &customRpcCodec{ newRPCCodec(conn, opts) }
+	return NewCustomRPCServerCodecWithOptions(conn, opts, nil)
+}
+
+// NewCustomRPCServerCodecWithOptions is like NewCustomRPCServerCodec, but decodes with the given DecoderOptions.
+func NewCustomRPCServerCodecWithOptions(conn io.ReadWriteCloser, dam DecoderContainerResolver, opts *DecoderOptions) (rpc.ServerCodec) {
+	return &customRpcCodec{ rpcCodec: newRPCCodec(conn, dam, opts) }
 }
 	
 // /////////////// RPC Codec Shared Methods ///////////////////
+
+// write encodes objs into the buffer of c.enc, and flushes them all as a single write.
+// If one fails to encode, nothing is written.
 func (c *rpcCodec) write(objs ...interface{}) (err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 	for _, obj := range objs {
-		if err = c.enc.Encode(obj); err != nil {
+		if err = c.enc.encodeBuffered(reflectValue(obj)); err != nil {
+			c.enc.buf = c.enc.buf[:0] // drop the objs before it too
 			return
 		}
 	}
-	return
+	return c.enc.Flush()
 }
 
 func (c *rpcCodec) read(objs ...interface{}) (err error) {
@@ -129,7 +194,7 @@ func (c *rpcCodec) maybeEOF(err error) (errx error) {
 		return nil
 	}
 	// defer func() { fmt.Printf("maybeEOF: orig: %T, %v, returning: %T, %v\n", err, err, errx, errx) }()
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
 		return io.EOF
 	} 
 	errstr := err.Error()
@@ -183,47 +248,89 @@ func (c *customRpcCodec) WriteRequest(r *rpc.Request, body interface{}) error {
 }
 
 func (c *customRpcCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Seq == rpcNotifySeq {
+		return nil
+	}
 	return c.writeCustomBody(1, r.Seq, r.Error, body)
 }
 
+func (c *customRpcCodec) Notify(method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	return c.write([]interface{}{ byte(2), method, params })
+}
+
+func (c *customRpcCodec) OnNotify(fn func(method string, params RawMessage)) {
+	c.nmu.Lock()
+	c.onNotify = fn
+	c.nmu.Unlock()
+}
+
 func (c *customRpcCodec) ReadRequestBody(body interface{}) error {
 	bodyArr := []interface{}{body}
 	return c.dec.Decode(&bodyArr)
 }
 
-func (c *customRpcCodec) ReadResponseHeader(r *rpc.Response) error {
-	return c.maybeEOF(c.parseCustomHeader(1, &r.Seq, &r.Error))
+func (c *customRpcCodec) ReadResponseHeader(r *rpc.Response) (err error) {
+	for {
+		var b byte
+		if b, err = c.parseCustomHeader(1); err != nil {
+			return c.maybeEOF(err)
+		}
+		if b == 1 {
+			return c.maybeEOF(c.read(&r.Seq, &r.Error))
+		}
+		var method string
+		var params RawMessage
+		if err = c.read(&method, &params); err != nil {
+			return c.maybeEOF(err)
+		}
+		c.nmu.Lock()
+		fn := c.onNotify
+		c.nmu.Unlock()
+		if fn != nil {
+			fn(method, params)
+		}
+	}
 }
 
-func (c *customRpcCodec) ReadRequestHeader(r *rpc.Request) error {
-	return c.maybeEOF(c.parseCustomHeader(0, &r.Seq, &r.ServiceMethod))
+func (c *customRpcCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	var b byte
+	if b, err = c.parseCustomHeader(0); err != nil {
+		return c.maybeEOF(err)
+	}
+	if b == 0 {
+		return c.maybeEOF(c.read(&r.Seq, &r.ServiceMethod))
+	}
+	r.Seq = rpcNotifySeq
+	return c.maybeEOF(c.read(&r.ServiceMethod))
 }
 
-func (c *customRpcCodec) parseCustomHeader(expectTypeByte byte, msgid *uint64, methodOrError *string) (err error) {
+// parseCustomHeader reads the array header and type byte of a message: 
+// expectTypeByte (in a four item array), or 2 (a notification, in a three item array).
+func (c *customRpcCodec) parseCustomHeader(expectTypeByte byte) (b byte, err error) {
 
-	// We read the response header by hand 
+	// We read the header by hand 
 	// so that the body can be decoded on its own from the stream at a later time.
 
-	bs := make([]byte, 1)
-	n, err := c.rwc.Read(bs)
+	n, err := c.dec.ReadArrayHeader()
 	if err != nil {
 		return 
 	}
-	if n != 1 {
-		err = fmt.Errorf("Couldn't read array descriptor: No bytes read")
+	if n != 4 && n != 3 {
+		err = fmt.Errorf("Unexpected length for message array: Expecting 4 (or 3 for notifications). Received %v", n)
 		return
 	}
-	const fia byte = 0x94 //four item array descriptor value
-	if bs[0] != fia {
-		err = fmt.Errorf("Unexpected value for array descriptor: Expecting %v. Received %v", fia, bs[0])
+	if err = c.read(&b); err != nil {
 		return
 	}
-	var b byte
-	if err = c.read(&b, msgid, methodOrError); err != nil {
-		return
+	expect := expectTypeByte
+	if n == 3 {
+		expect = 2
 	}
-	if b != expectTypeByte {
-		err = fmt.Errorf("Unexpected byte descriptor in header. Expecting %v. Received %v", expectTypeByte, b)
+	if b != expect {
+		err = fmt.Errorf("Unexpected byte descriptor in header. Expecting %v. Received %v", expect, b)
 		return
 	}
 	return
@@ -241,6 +348,6 @@ func (c *customRpcCodec) writeCustomBody(typeByte byte, msgid uint64, methodOrEr
 		}
 	}
 	r2 := []interface{}{ typeByte, uint32(msgid), moe, body }
-	return c.enc.Encode(r2)
+	return c.write(r2)
 }
 
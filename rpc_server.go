@@ -0,0 +1,419 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+)
+
+var (
+	contextTyp = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorTyp = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Server is a msgpack-rpc server (see http://wiki.msgpack.org/display/MSGPACK/RPC+specification), 
+// independent of net/rpc. 
+// 
+// It calls registered Go functions and methods of any signature, mapping the 
+// params array of each request onto their arguments by position:
+//    - a first argument of type context.Context is not a param. It gets the 
+//      Context passed to ServeConnContext.
+//    - the number of params must match the (other) arguments, 
+//      or be at least the number of non-variadic arguments.
+//    - each param is decoded into the type of its argument (see Decoder.Decode).
+// 
+// A function may return nothing, a result, an error, or (result, error). 
+// The response holds the result, or the error's message (the spec leaves the 
+// error object open, and most peers expect a string). A panic in a function 
+// is returned as an error.
+// 
+// For compatibility with net/rpc (and NewCustomRPCClientCodec), a method of the 
+// form Method(arg T, reply *R) error which gets a single param is passed a new *R, 
+// which is the result.
+// 
+// Requests on a connection are served concurrently (up to ServerOptions.MaxPending), 
+// and responses are written as they complete. Notifications are dispatched like 
+// requests, without a response.
+// 
+// Sample Usage:
+//   srv := msgpack.NewServer(nil)
+//   srv.RegisterFunc("add", func(a, b int) int { return a + b })
+//   srv.Register(new(Arith)) // methods named "Arith.XXX"
+//   err = srv.Serve(listener)
+type Server struct {
+	dam DecoderContainerResolver
+	opts ServerOptions
+	mu sync.RWMutex
+	methods map[string]*rpcMethod
+}
+
+// Default ServerOptions used when a nil parameter is passed to NewServerWithOptions()
+// (and by NewServer). The decoder limits suit messages from untrusted peers.
+// Sample Usage:
+//   opts := msgpack.DefaultServerOptions // makes a copy
+//   opts.DecoderOptions.MaxBytes = 64 << 20 // allow larger params
+//   srv := msgpack.NewServerWithOptions(nil, &opts)
+var DefaultServerOptions = ServerOptions {
+	DecoderOptions: DecoderOptions {
+		BinaryUnmarshaler: true,
+		TextUnmarshaler: true,
+		MaxContainerLen: 1 << 16,
+		MaxStringLen: 1 << 20,
+		MaxDepth: 100,
+		MaxBytes: 4 << 20,
+	},
+	MaxPending: 64,
+}
+
+// ServerOptions configures a Server.
+type ServerOptions struct {
+	// DecoderOptions is used to read messages from a connection, and to decode 
+	// their params. Its limits apply to each message as a whole (e.g. MaxBytes 
+	// bounds the size of a message), and again to each param.
+	DecoderOptions DecoderOptions
+	// MaxPending is the maximum number of requests (and notifications) served 
+	// at a time on a connection. When it is reached, the server stops reading 
+	// from the connection until one completes. A value of 0 means no limit.
+	MaxPending int
+}
+
+// rpcMethod is a function registered with a Server.
+type rpcMethod struct {
+	name string
+	fn reflect.Value
+	hasCtx bool
+	argTypes []reflect.Type  // excluding the context. If variadic, the last is a slice.
+	variadic bool
+	hasResult bool
+	hasErr bool
+	netrpc bool  // of the form Method(arg T, reply *R) error
+}
+
+// NewServer returns a Server, which decodes params using the given 
+// DecoderContainerResolver (or DefaultDecoderContainerResolver if nil).
+func NewServer(dam DecoderContainerResolver) *Server {
+	return NewServerWithOptions(dam, nil)
+}
+
+// NewServerWithOptions returns a Server configured by the given options.
+// A nil opts means DefaultServerOptions.
+func NewServerWithOptions(dam DecoderContainerResolver, opts *ServerOptions) *Server {
+	if opts == nil {
+		opts = &DefaultServerOptions
+	}
+	return &Server{dam: dam, opts: *opts, methods: make(map[string]*rpcMethod)}
+}
+
+// RegisterFunc registers fn (a func, see Server) as the method name.
+func (s *Server) RegisterFunc(name string, fn interface{}) error {
+	m, err := newRPCMethod(name, reflect.ValueOf(fn))
+	if err != nil {
+		return err
+	}
+	return s.add(m)
+}
+
+// Register registers the exported methods of rcvr as "Type.Method", 
+// where Type is the name of the concrete type of rcvr (e.g. "Arith.Add"), 
+// as net/rpc does. Methods with an unsupported signature are skipped.
+func (s *Server) Register(rcvr interface{}) error {
+	return s.RegisterName(reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name(), rcvr)
+}
+
+// RegisterName is like Register, but uses name instead of the type name.
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		return fmt.Errorf("msgpack-rpc: no name for type %T", rcvr)
+	}
+	rv := reflect.ValueOf(rcvr)
+	var ms []*rpcMethod
+	for i := 0; i < rv.NumMethod(); i++ {
+		if m, err := newRPCMethod(name + "." + rv.Type().Method(i).Name, rv.Method(i)); err == nil {
+			ms = append(ms, m)
+		}
+	}
+	if len(ms) == 0 {
+		return fmt.Errorf("msgpack-rpc: type %T has no exported methods of suitable type", rcvr)
+	}
+	return s.add(ms...)
+}
+
+func (s *Server) add(ms ...*rpcMethod) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range ms {
+		if _, ok := s.methods[m.name]; ok {
+			return fmt.Errorf("msgpack-rpc: method already defined: %s", m.name)
+		}
+	}
+	for _, m := range ms {
+		s.methods[m.name] = m
+	}
+	return nil
+}
+
+func newRPCMethod(name string, fn reflect.Value) (m *rpcMethod, err error) {
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return nil, fmt.Errorf("msgpack-rpc: %s: expecting a func. Got: %v", name, fn.Kind())
+	}
+	ft := fn.Type()
+	m = &rpcMethod{name: name, fn: fn, variadic: ft.IsVariadic()}
+	for i := 0; i < ft.NumIn(); i++ {
+		if i == 0 && ft.In(i) == contextTyp {
+			m.hasCtx = true
+			continue
+		}
+		m.argTypes = append(m.argTypes, ft.In(i))
+	}
+	switch ft.NumOut() {
+	case 0:
+	case 1:
+		m.hasErr = ft.Out(0) == errorTyp
+		m.hasResult = !m.hasErr
+	case 2:
+		if ft.Out(1) != errorTyp {
+			return nil, fmt.Errorf("msgpack-rpc: %s: second result must be an error. Got: %v", name, ft.Out(1))
+		}
+		m.hasResult, m.hasErr = true, true
+	default:
+		return nil, fmt.Errorf("msgpack-rpc: %s: expecting at most 2 results. Got: %d", name, ft.NumOut())
+	}
+	m.netrpc = !m.variadic && len(m.argTypes) == 2 && m.argTypes[1].Kind() == reflect.Ptr && 
+		m.hasErr && !m.hasResult
+	return
+}
+
+// call decodes params (the encoded params array) into the arguments of m, and calls it.
+func (m *rpcMethod) call(ctx context.Context, dam DecoderContainerResolver, opts *DecoderOptions, 
+	params RawMessage) (result interface{}, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("msgpack-rpc: panic in %s: %v", m.name, x)
+		}
+	}()
+	// nil (or missing) params are taken as no params.
+	d := NewDecoderBytesWithOptions(params, dam, opts)
+	var n int
+	if len(params) > 0 && params[0] != 0xc0 {
+		if n, err = d.ReadArrayHeader(); err != nil {
+			return nil, fmt.Errorf("msgpack-rpc: %s: reading params: %w", m.name, err)
+		}
+	}
+	numFixed := len(m.argTypes)
+	var reply reflect.Value
+	if m.netrpc && n == 1 {
+		numFixed--
+		reply = reflect.New(m.argTypes[1].Elem())
+	}
+	if m.variadic {
+		numFixed--
+		if n < numFixed {
+			return nil, fmt.Errorf("msgpack-rpc: %s: expecting at least %d params. Got: %d", m.name, numFixed, n)
+		}
+	} else if n != numFixed {
+		return nil, fmt.Errorf("msgpack-rpc: %s: expecting %d params. Got: %d", m.name, numFixed, n)
+	}
+	args := make([]reflect.Value, 0, n + 1)
+	if m.hasCtx {
+		args = append(args, reflect.ValueOf(&ctx).Elem())
+	}
+	for i := 0; i < n; i++ {
+		var rt reflect.Type
+		if i < numFixed {
+			rt = m.argTypes[i]
+		} else {
+			rt = m.argTypes[numFixed].Elem()
+		}
+		rv := reflect.New(rt)
+		if err = d.DecodeValue(rv); err != nil {
+			return nil, fmt.Errorf("msgpack-rpc: %s: param %d: %w", m.name, i, err)
+		}
+		args = append(args, rv.Elem())
+	}
+	if reply.IsValid() {
+		args = append(args, reply)
+		result = reply.Interface()
+	}
+	outs := m.fn.Call(args)
+	if m.hasErr {
+		if e := outs[len(outs) - 1]; !e.IsNil() {
+			return nil, e.Interface().(error)
+		}
+	}
+	if m.hasResult {
+		result = outs[0].Interface()
+	}
+	return
+}
+
+// Serve accepts connections on l and serves each (see ServeConn) in a new goroutine, 
+// until Accept fails. It returns that error.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves msgpack-rpc on conn (see ServeConnContext), 
+// with context.Background() for functions taking a context.Context.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) error {
+	return s.ServeConnContext(context.Background(), conn)
+}
+
+// ServeConnContext reads requests and notifications from conn, dispatches them,
+// and writes the responses, until conn is closed or a message is invalid 
+// (or exceeds a limit in ServerOptions.DecoderOptions). 
+// Functions taking a context.Context are passed a Context derived from ctx, 
+// which is canceled when reading stops. ServeConnContext then waits for pending 
+// requests, and closes conn. It returns nil at the end of the stream, or else 
+// the error which stopped it.
+func (s *Server) ServeConnContext(ctx context.Context, conn io.ReadWriteCloser) (err error) {
+	var wg sync.WaitGroup
+	var wmu sync.Mutex // serializes responses
+	var sem chan struct{} // bounds pending requests, if MaxPending > 0
+	if s.opts.MaxPending > 0 {
+		sem = make(chan struct{}, s.opts.MaxPending)
+	}
+	dopts := &s.opts.DecoderOptions
+	dec := NewDecoderWithOptions(conn, nil, dopts)
+	mopts := *dopts
+	mopts.AliasInput = true // params refer to the message, read anew each time
+	mdec := NewDecoderBytesWithOptions(nil, nil, &mopts)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		wg.Wait()
+		conn.Close()
+	}()
+	for {
+		var typ byte
+		var msgid uint32
+		var method string
+		var params RawMessage
+		if typ, msgid, method, params, err = readRPCMessage(dec, mdec); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		s.mu.RLock()
+		m := s.methods[method]
+		s.mu.RUnlock()
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				if sem != nil {
+					<-sem
+				}
+				wg.Done()
+			}()
+			var result interface{}
+			var err error
+			if m == nil {
+				err = fmt.Errorf("msgpack-rpc: can't find method %s", method)
+			} else {
+				result, err = m.call(ctx, s.dam, dopts, params)
+			}
+			if typ == 2 {
+				return
+			}
+			b, err := encodeRPCResponse(msgid, result, err)
+			if err != nil {
+				// the result could not be encoded: send the error instead
+				b, _ = encodeRPCResponse(msgid, nil, err)
+			}
+			// A write error means conn is broken, which the read loop will see.
+			wmu.Lock()
+			conn.Write(b)
+			wmu.Unlock()
+		}()
+	}
+}
+
+// readRPCMessage reads a request [0, msgid, method, params] or notification [2, method, params].
+// It reads the whole message from dec with a single Decode, so the limits apply to it 
+// as a whole, then parses it with mdec.
+func readRPCMessage(dec, mdec *Decoder) (typ byte, msgid uint32, method string, params RawMessage, err error) {
+	var msg RawMessage
+	if err = dec.Decode(&msg); err != nil {
+		return
+	}
+	mdec.ResetBytes(msg)
+	dec = mdec
+	n, err := dec.ReadArrayHeader()
+	if err != nil {
+		return
+	}
+	t, err := dec.ReadUint()
+	if err != nil {
+		return
+	}
+	switch typ = byte(t); {
+	case t == 0 && n == 4:
+		var id uint64
+		if id, err = dec.ReadUint(); err != nil {
+			return
+		}
+		msgid = uint32(id)
+	case t == 2 && n == 3:
+	default:
+		err = fmt.Errorf("msgpack-rpc: unexpected message of type %d in an array of %d elements", t, n)
+		return
+	}
+	if method, err = dec.ReadString(); err != nil {
+		return
+	}
+	err = dec.Decode(&params)
+	return
+}
+
+// encodeRPCResponse encodes the response [1, msgid, error, result].
+func encodeRPCResponse(msgid uint32, result interface{}, err error) ([]byte, error) {
+	var e interface{}
+	if err != nil {
+		e, result = err.Error(), nil
+	}
+	return Marshal([]interface{}{ byte(1), msgid, e, result })
+}